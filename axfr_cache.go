@@ -0,0 +1,130 @@
+package mdns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//
+// AXFR wire cache
+//
+
+// AxfrCache keeps the packed, compressed messages of an AXFR for each zone
+// serial, so repeat transfers of an unchanged zone are written straight to
+// the connection without packing anything. It is bounded by the total size
+// of the messages, evicting the least recently used transfers first.
+type AxfrCache struct {
+	maxBytes int
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[axfrKey]*list.Element
+	bytes   int
+}
+
+type axfrKey struct {
+	qname  string
+	serial uint32
+}
+
+type axfrEntry struct {
+	key   axfrKey
+	msgs  [][]byte
+	bytes int
+}
+
+func NewAxfrCache(maxBytes int) *AxfrCache {
+	return &AxfrCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[axfrKey]*list.Element{},
+	}
+}
+
+// Get returns the packed messages for the transfer, or nil. qname is
+// matched exactly, since it's packed into every message.
+func (cache *AxfrCache) Get(qname string, serial uint32) [][]byte {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[axfrKey{qname, serial}]
+	if !ok {
+		cacheMisses.WithLabelValues("axfr_wire").Inc()
+		return nil
+	}
+	cache.lru.MoveToFront(element)
+	cacheHits.WithLabelValues("axfr_wire").Inc()
+	return element.Value.(*axfrEntry).msgs
+}
+
+// Put stores the packed messages for a transfer. They must not be modified
+// afterwards.
+func (cache *AxfrCache) Put(qname string, serial uint32, msgs [][]byte) {
+	entry := &axfrEntry{key: axfrKey{qname, serial}, msgs: msgs}
+	for _, msg := range msgs {
+		entry.bytes += len(msg)
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if entry.bytes > cache.maxBytes {
+		return
+	}
+	if element, ok := cache.entries[entry.key]; ok {
+		cache.remove(element)
+	}
+	cache.entries[entry.key] = cache.lru.PushFront(entry)
+	cache.bytes += entry.bytes
+
+	for cache.bytes > cache.maxBytes {
+		cache.remove(cache.lru.Back())
+		cacheEvictions.Inc()
+	}
+}
+
+// remove must be called with the mutex held
+func (cache *AxfrCache) remove(element *list.Element) {
+	entry := cache.lru.Remove(element).(*axfrEntry)
+	delete(cache.entries, entry.key)
+	cache.bytes -= entry.bytes
+}
+
+// Flush empties the cache, for when records may have changed without the
+// serial moving, as on a SIGHUP.
+func (cache *AxfrCache) Flush() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.lru.Init()
+	cache.entries = map[axfrKey]*list.Element{}
+	cache.bytes = 0
+	log.Info("Flushed the AXFR cache")
+}
+
+func (cache *AxfrCache) Stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return CacheStats{Entries: len(cache.entries), Bytes: cache.bytes}
+}
+
+// stampReply copies a packed reply and fills in the header fields that
+// SetReply takes from the request: the id, RD and CD.
+func stampReply(packed []byte, id uint16, recursionDesired, checkingDisabled bool) []byte {
+	msg := make([]byte, len(packed))
+	copy(msg, packed)
+
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	msg[2] &^= 0x01
+	if recursionDesired {
+		msg[2] |= 0x01
+	}
+	msg[3] &^= 0x10
+	if checkingDisabled {
+		msg[3] |= 0x10
+	}
+	return msg
+}
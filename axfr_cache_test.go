@@ -0,0 +1,51 @@
+package mdns_test
+
+import (
+	"testing"
+
+	"github.com/rackerlabs/mdns"
+)
+
+func TestAxfrCache(t *testing.T) {
+	cache := mdns.NewAxfrCache(100)
+
+	assert(t, cache.Get("gomdns.com.", 1) == nil, "Nothing should be cached yet")
+
+	msgs := [][]byte{make([]byte, 20), make([]byte, 20)}
+	cache.Put("gomdns.com.", 1, msgs)
+	equals(t, msgs, cache.Get("gomdns.com.", 1))
+	equals(t, mdns.CacheStats{Entries: 1, Bytes: 40}, cache.Stats())
+
+	// A new serial is a new transfer
+	assert(t, cache.Get("gomdns.com.", 2) == nil, "Serial 2 isn't cached")
+}
+
+func TestAxfrCacheEviction(t *testing.T) {
+	cache := mdns.NewAxfrCache(100)
+
+	cache.Put("a.com.", 1, [][]byte{make([]byte, 40)})
+	cache.Put("b.com.", 1, [][]byte{make([]byte, 40)})
+	// Use a.com. so b.com. is the least recently used
+	cache.Get("a.com.", 1)
+	cache.Put("c.com.", 1, [][]byte{make([]byte, 40)})
+
+	assert(t, cache.Get("a.com.", 1) != nil, "a.com. should still be cached")
+	assert(t, cache.Get("b.com.", 1) == nil, "b.com. should have been evicted")
+	assert(t, cache.Get("c.com.", 1) != nil, "c.com. should be cached")
+
+	// Bigger than the whole cache
+	cache.Put("d.com.", 1, [][]byte{make([]byte, 101)})
+	assert(t, cache.Get("d.com.", 1) == nil, "d.com. is too big to cache")
+}
+
+func TestAxfrCacheFlush(t *testing.T) {
+	cache := mdns.NewAxfrCache(100)
+	cache.Put("a.com.", 1, [][]byte{make([]byte, 40)})
+	cache.Flush()
+
+	assert(t, cache.Get("a.com.", 1) == nil, "a.com. should have been flushed")
+	equals(t, mdns.CacheStats{}, cache.Stats())
+
+	cache.Put("a.com.", 1, [][]byte{make([]byte, 40)})
+	assert(t, cache.Get("a.com.", 1) != nil, "a.com. should be cached again")
+}
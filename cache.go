@@ -0,0 +1,554 @@
+package mdns
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Cache
+//
+
+var (
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "cache_hits_total",
+		Help:      "Lookups answered from the cache, by kind (axfr, query).",
+	}, []string{"kind"})
+
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "cache_misses_total",
+		Help:      "Lookups that had to go to the storage driver, by kind (axfr, query).",
+	}, []string{"kind"})
+
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "cache_evictions_total",
+		Help:      "Cache entries evicted to stay under the size limit.",
+	})
+
+	cacheInvalidations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "cache_invalidations_total",
+		Help:      "Zones dropped from the cache because their serial changed.",
+	})
+
+	unconfirmedAnswers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "unconfirmed_answers_total",
+		Help:      "Lookups answered from snapshot data that hasn't been revalidated yet, by kind (axfr, query).",
+	}, []string{"kind"})
+
+	staleAnswers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "stale_answers_total",
+		Help:      "Lookups answered with stale data because the storage driver failed, by kind (axfr, query).",
+	}, []string{"kind"})
+
+	cacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mdns",
+		Name:      "cache_bytes",
+		Help:      "Estimated memory used by cached records.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses, cacheEvictions, cacheInvalidations, unconfirmedAnswers, staleAnswers, cacheBytes)
+}
+
+// Rough per-RR cost on top of its wire length, for the Go structs
+const rrOverhead = 64
+
+// CachingDriver wraps another driver and keeps the parsed RRs it returns,
+// for whole zones (AXFR) and for (name, type) lookups. The cache is bounded
+// by an estimate of the memory the RRs use, evicting the least recently used
+// entries first. Entries for a zone are dropped when its serial changes.
+//
+// With serve-stale (RFC 8767) turned on, invalidated entries are kept as the
+// last known-good data instead, and are used if the driver fails. So are
+// entries that haven't been confirmed by a serial poll for a while.
+//
+// The RRs returned are shared between callers and must not be modified.
+type CachingDriver struct {
+	driver   Driver
+	maxBytes int
+
+	serveStale   bool
+	limited      bool
+	maxStaleness time.Duration
+	staleTtl     uint32
+
+	mutex        sync.Mutex
+	lru          *list.List
+	entries      map[string]*list.Element
+	bytes        int
+	serials      map[string]uint32
+	generation   uint64
+	pollInterval time.Duration
+	lastPoll     time.Time
+	known        map[string]bool // Every zone in the loaded snapshot
+	stop         chan struct{}
+	workers      sync.WaitGroup
+}
+
+type cacheEntry struct {
+	key   string
+	kind  string
+	name  string
+	rrs   []dns.RR
+	bytes int
+	// When the data was last known to be current
+	confirmed time.Time
+	invalid   bool
+	// Loaded from a snapshot, and not yet checked against the driver
+	unconfirmed bool
+	serial      uint32
+}
+
+type CacheStats struct {
+	Entries int
+	Bytes   int
+	Stale   int
+}
+
+func NewCachingDriver(driver Driver, maxBytes int) *CachingDriver {
+	return &CachingDriver{
+		driver:   driver,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		serials:  map[string]uint32{},
+	}
+}
+
+// ServeStale turns on serve-stale, within the StaleLimits given.
+func (cache *CachingDriver) ServeStale(maxStaleness time.Duration, staleTtl uint32) {
+	cache.StaleLimits(maxStaleness, staleTtl)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.serveStale = true
+}
+
+// StaleLimits bounds data that can't be checked against the driver: stale
+// data with serve-stale, and snapshot data that hasn't been revalidated yet.
+// It is served for up to maxStaleness after it was last known to be current,
+// and query answers have their TTLs capped at staleTtl. AXFRs are sent
+// unchanged. Without limits, snapshot data is served until revalidated.
+func (cache *CachingDriver) StaleLimits(maxStaleness time.Duration, staleTtl uint32) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.limited = true
+	cache.maxStaleness = maxStaleness
+	cache.staleTtl = staleTtl
+}
+
+func (cache *CachingDriver) Open() error {
+	return cache.driver.Open()
+}
+
+func (cache *CachingDriver) Ping(ctx context.Context) error {
+	return cache.driver.Ping(ctx)
+}
+
+func (cache *CachingDriver) FindZone(ctx context.Context, qname string) (Zone, error) {
+	return cache.driver.FindZone(ctx, qname)
+}
+
+func (cache *CachingDriver) GetZoneSerials(ctx context.Context) (map[string]uint32, error) {
+	return cache.driver.GetZoneSerials(ctx)
+}
+
+func (cache *CachingDriver) GetFullAxfrRRs(ctx context.Context, zonename string) ([]dns.RR, error) {
+	key := "axfr:" + strings.ToLower(zonename)
+	return cache.lookup(ctx, key, "axfr", zonename, func() ([]dns.RR, error) {
+		return cache.driver.GetFullAxfrRRs(ctx, zonename)
+	})
+}
+
+func (cache *CachingDriver) GetQueryRRs(ctx context.Context, RRName string, RRType string) ([]dns.RR, error) {
+	if rrs, ok := cache.fromUnconfirmedZone(RRName, RRType); ok {
+		unconfirmedAnswers.WithLabelValues("query").Inc()
+		return rrs, nil
+	}
+
+	key := "query:" + strings.ToLower(RRName) + "/" + RRType
+	return cache.lookup(ctx, key, "query", RRName, func() ([]dns.RR, error) {
+		return cache.driver.GetQueryRRs(ctx, RRName, RRType)
+	})
+}
+
+func (cache *CachingDriver) lookup(ctx context.Context, key, kind, name string, fetch func() ([]dns.RR, error)) ([]dns.RR, error) {
+	var last cacheEntry
+	cache.mutex.Lock()
+	element, found := cache.entries[key]
+	if found {
+		cache.lru.MoveToFront(element)
+		last = *element.Value.(*cacheEntry)
+		if !last.invalid && last.unconfirmed && cache.servable(&last) {
+			cache.mutex.Unlock()
+			unconfirmedAnswers.WithLabelValues(kind).Inc()
+			return cache.unconfirmed(last.rrs, kind), nil
+		}
+		if !last.invalid && !last.unconfirmed && cache.trusted() {
+			cache.mutex.Unlock()
+			cacheHits.WithLabelValues(kind).Inc()
+			return last.rrs, nil
+		}
+		last.confirmed = cache.confirmed(&last)
+	}
+	generation := cache.generation
+	cache.mutex.Unlock()
+
+	cacheMisses.WithLabelValues(kind).Inc()
+	rrs, err := fetch()
+	if err != nil {
+		if found && cache.serveStale && err != sql.ErrNoRows && err != ErrZoneRefused && time.Since(last.confirmed) <= cache.maxStaleness {
+			return cache.stale(LoggerFrom(ctx), &last, err), nil
+		}
+		return rrs, err
+	}
+
+	entry := &cacheEntry{key: key, kind: kind, name: strings.ToLower(name), rrs: rrs, bytes: rrsSize(rrs), confirmed: time.Now()}
+	if soa, ok := firstSOA(rrs); ok && kind == "axfr" {
+		entry.serial = soa.Serial
+	}
+	cache.put(entry, generation)
+	return rrs, nil
+}
+
+// fromUnconfirmedZone answers a query from the AXFR entry of the closest
+// enclosing zone, if that entry came from a snapshot and hasn't been
+// revalidated yet. Otherwise queries go through the usual lookup. A zone
+// the snapshot knew of but didn't keep stops the walk, so a parent zone
+// never answers for a child's names.
+func (cache *CachingDriver) fromUnconfirmedZone(RRName string, RRType string) ([]dns.RR, bool) {
+	name := strings.ToLower(RRName)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		element, ok := cache.entries["axfr:"+name[off:]]
+		if !ok {
+			if cache.known[name[off:]] {
+				return nil, false
+			}
+			continue
+		}
+		entry := element.Value.(*cacheEntry)
+		if entry.invalid || !entry.unconfirmed || !cache.servable(entry) {
+			return nil, false
+		}
+
+		return cache.unconfirmed(axfrAnswers(entry.rrs, name, RRType), "query"), true
+	}
+	return nil, false
+}
+
+// servable is whether an unconfirmed entry is still within the stale limits.
+// Called with the mutex held.
+func (cache *CachingDriver) servable(entry *cacheEntry) bool {
+	return !cache.limited || time.Since(entry.confirmed) <= cache.maxStaleness
+}
+
+// unconfirmed returns the RRs of an unconfirmed entry, with TTLs capped for
+// queries if there are stale limits. Called with the mutex held.
+func (cache *CachingDriver) unconfirmed(rrs []dns.RR, kind string) []dns.RR {
+	if !cache.limited {
+		return rrs
+	}
+	return cache.capTtls(rrs, kind)
+}
+
+// trusted is whether valid entries can be served without asking the driver,
+// which is true as long as serial polls are succeeding. Called with the
+// mutex held.
+func (cache *CachingDriver) trusted() bool {
+	if !cache.serveStale || cache.pollInterval == 0 {
+		return true
+	}
+	return time.Since(cache.lastPoll) <= 3*cache.pollInterval
+}
+
+// confirmed is the last time entry was known to be current. Called with the
+// mutex held.
+func (cache *CachingDriver) confirmed(entry *cacheEntry) time.Time {
+	if !entry.invalid && cache.lastPoll.After(entry.confirmed) {
+		return cache.lastPoll
+	}
+	return entry.confirmed
+}
+
+// stale returns the RRs of an entry being served past its time, with TTLs
+// capped for queries.
+func (cache *CachingDriver) stale(logger *log.Entry, entry *cacheEntry, err error) []dns.RR {
+	staleAnswers.WithLabelValues(entry.kind).Inc()
+	logger.Warn(fmt.Sprintf("Serving stale %s for %s, last current %s ago: %s",
+		entry.kind, entry.name, time.Since(entry.confirmed), err))
+
+	return cache.capTtls(entry.rrs, entry.kind)
+}
+
+// capTtls returns copies of query answers with their TTLs capped at the
+// stale TTL. AXFRs are returned unchanged.
+func (cache *CachingDriver) capTtls(rrs []dns.RR, kind string) []dns.RR {
+	if kind == "axfr" {
+		return rrs
+	}
+	capped := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		capped[i] = dns.Copy(rr)
+		if capped[i].Header().Ttl > cache.staleTtl {
+			capped[i].Header().Ttl = cache.staleTtl
+		}
+	}
+	return capped
+}
+
+// put adds an entry, unless something was invalidated since the lookup
+// started, in which case what was fetched may already be out of date.
+func (cache *CachingDriver) put(entry *cacheEntry, generation uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if generation != cache.generation || entry.bytes > cache.maxBytes {
+		return
+	}
+	if element, ok := cache.entries[entry.key]; ok {
+		cache.remove(element)
+	}
+	cache.entries[entry.key] = cache.lru.PushFront(entry)
+	cache.bytes += entry.bytes
+
+	for cache.bytes > cache.maxBytes {
+		cache.remove(cache.lru.Back())
+		cacheEvictions.Inc()
+	}
+	cacheBytes.Set(float64(cache.bytes))
+}
+
+// remove must be called with the mutex held
+func (cache *CachingDriver) remove(element *list.Element) {
+	entry := cache.lru.Remove(element).(*cacheEntry)
+	delete(cache.entries, entry.key)
+	cache.bytes -= entry.bytes
+}
+
+// Invalidate drops every entry for the zone, and the names in it. With
+// serve-stale they're kept as the last known-good data instead.
+func (cache *CachingDriver) Invalidate(zonename string) {
+	zonename = strings.ToLower(zonename)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.generation++
+	for element := cache.lru.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*cacheEntry)
+		if dns.IsSubDomain(zonename, entry.name) {
+			if cache.serveStale {
+				if !entry.invalid {
+					entry.confirmed = cache.confirmed(entry)
+					entry.invalid = true
+				}
+			} else {
+				cache.remove(element)
+			}
+		}
+		element = next
+	}
+	cacheBytes.Set(float64(cache.bytes))
+	cacheInvalidations.Inc()
+}
+
+// Notify passes a NOTIFY on to the wrapped driver, if it transfers zones.
+func (cache *CachingDriver) Notify(zonename string) {
+	if secondary, ok := cache.driver.(zoneNotifier); ok {
+		secondary.Notify(zonename)
+	}
+}
+
+// Masters returns the masters of a zone the wrapped driver transfers.
+func (cache *CachingDriver) Masters(zonename string) []string {
+	if secondary, ok := cache.driver.(zoneNotifier); ok {
+		return secondary.Masters(zonename)
+	}
+	return nil
+}
+
+// Flush empties the cache.
+func (cache *CachingDriver) Flush() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.generation++
+	cache.lru.Init()
+	cache.entries = map[string]*list.Element{}
+	cache.bytes = 0
+	cacheBytes.Set(0)
+	log.Info("Flushed the cache")
+}
+
+func (cache *CachingDriver) Stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	stats := CacheStats{Entries: len(cache.entries), Bytes: cache.bytes}
+	for _, element := range cache.entries {
+		if element.Value.(*cacheEntry).invalid {
+			stats.Stale++
+		}
+	}
+	return stats
+}
+
+// PollSerials fetches every zone serial once, and invalidates the zones
+// whose serial changed since the last poll.
+func (cache *CachingDriver) PollSerials() error {
+	ctx, cancel := withTimeout(WithLogger(context.Background(), log.WithField("poller", "cache")), Conf.QueryTimeout)
+	defer cancel()
+	serials, err := cache.driver.GetZoneSerials(ctx)
+	if err != nil {
+		return err
+	}
+
+	cache.mutex.Lock()
+	previous := cache.serials
+	cache.serials = serials
+	cache.lastPoll = time.Now()
+	cache.mutex.Unlock()
+
+	cache.revalidate(serials)
+
+	for zonename, serial := range previous {
+		if current, ok := serials[zonename]; !ok || current != serial {
+			log.Debug(fmt.Sprintf("Serial for %s changed %d -> %d, invalidating", zonename, serial, current))
+			cache.Invalidate(zonename)
+		}
+	}
+	// A zone that wasn't there last time could have been cached by name
+	// while it didn't exist.
+	for zonename := range serials {
+		if _, ok := previous[zonename]; !ok && len(previous) > 0 {
+			cache.Invalidate(zonename)
+		}
+	}
+	return nil
+}
+
+// revalidate confirms the snapshot entries whose serial is still current,
+// and invalidates the rest.
+func (cache *CachingDriver) revalidate(serials map[string]uint32) {
+	changed := []string{}
+
+	cache.mutex.Lock()
+	now := time.Now()
+	for _, element := range cache.entries {
+		entry := element.Value.(*cacheEntry)
+		if !entry.unconfirmed {
+			continue
+		}
+		entry.unconfirmed = false
+		if serial, ok := serials[entry.name]; ok && serial == entry.serial {
+			entry.confirmed = now
+		} else {
+			changed = append(changed, entry.name)
+		}
+	}
+	cache.mutex.Unlock()
+
+	for _, zonename := range changed {
+		log.Info(fmt.Sprintf("Snapshot of %s is out of date, invalidating", zonename))
+		cache.Invalidate(zonename)
+	}
+}
+
+// StartPolling polls serials every interval until Stop is called.
+func (cache *CachingDriver) StartPolling(interval time.Duration) {
+	cache.mutex.Lock()
+	cache.pollInterval = interval
+	cache.mutex.Unlock()
+
+	stop := cache.stopChan()
+	cache.workers.Add(1)
+	go func() {
+		defer cache.workers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := cache.PollSerials(); err != nil {
+				log.Error(fmt.Sprintf("Error polling zone serials: %s", err))
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (cache *CachingDriver) stopChan() chan struct{} {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.stop == nil {
+		cache.stop = make(chan struct{})
+	}
+	return cache.stop
+}
+
+// Stop ends serial polling and snapshots, and waits for them to finish,
+// which includes writing the last snapshot.
+func (cache *CachingDriver) Stop() {
+	cache.mutex.Lock()
+	if cache.stop != nil {
+		close(cache.stop)
+		cache.stop = nil
+	}
+	cache.mutex.Unlock()
+	cache.workers.Wait()
+}
+
+// axfrAnswers picks the records a query for RRName and RRType would get out
+// of rrs, a whole zone in AXFR order.
+func axfrAnswers(rrs []dns.RR, RRName string, RRType string) []dns.RR {
+	answers := []dns.RR{}
+	if len(rrs) == 0 {
+		return answers
+	}
+	// The SOA is on both ends of an AXFR, skip the last one
+	for _, rr := range rrs[:len(rrs)-1] {
+		if !strings.EqualFold(rr.Header().Name, RRName) {
+			continue
+		}
+		if RRType == "ANY" || dns.Type(rr.Header().Rrtype).String() == RRType {
+			answers = append(answers, rr)
+		}
+	}
+	return answers
+}
+
+func firstSOA(rrs []dns.RR) (*dns.SOA, bool) {
+	if len(rrs) == 0 {
+		return nil, false
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	return soa, ok
+}
+
+func rrsSize(rrs []dns.RR) int {
+	size := rrOverhead
+	for _, rr := range rrs {
+		size += dns.Len(rr) + rrOverhead
+	}
+	return size
+}
@@ -0,0 +1,125 @@
+package mdns_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rackerlabs/mdns"
+)
+
+func openCache(tb testing.TB, maxBytes int) *mdns.CachingDriver {
+	mysql := &mdns.MySQLDriver{}
+	ok(tb, mysql.Open())
+	return mdns.NewCachingDriver(mysql, maxBytes)
+}
+
+func TestCacheAxfr(t *testing.T) {
+	SetUp()
+
+	cache := openCache(t, 1<<20)
+	storage := mdns.Storage{Driver: cache}
+
+	rrs, err := storage.Driver.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	assert(t, len(rrs) == 3, fmt.Sprintf("Wrong number of records: %d", len(rrs)))
+	assert(t, cache.Stats().Entries == 1, fmt.Sprintf("Wrong number of entries: %d", cache.Stats().Entries))
+
+	cached, err := storage.Driver.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	assert(t, &cached[0] == &rrs[0], "The second AXFR should have come from the cache")
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	SetUp()
+
+	cache := openCache(t, 1<<20)
+
+	_, err := cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	_, err = cache.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	assert(t, cache.Stats().Entries == 2, fmt.Sprintf("Wrong number of entries: %d", cache.Stats().Entries))
+
+	cache.Invalidate("example.com.")
+	assert(t, cache.Stats().Entries == 2, "Invalidating another zone should keep the entries")
+
+	cache.Invalidate("GOMDNS.com.")
+	equals(t, mdns.CacheStats{Entries: 0, Bytes: 0}, cache.Stats())
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	SetUp()
+
+	// Too small to hold anything
+	cache := openCache(t, 10)
+
+	_, err := cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	equals(t, mdns.CacheStats{Entries: 0, Bytes: 0}, cache.Stats())
+}
+
+func TestCachePollSerials(t *testing.T) {
+	SetUp()
+
+	cache := openCache(t, 1<<20)
+	ok(t, cache.PollSerials())
+
+	_, err := cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+
+	// Nothing changed, so nothing is invalidated
+	ok(t, cache.PollSerials())
+	assert(t, cache.Stats().Entries == 1, fmt.Sprintf("Wrong number of entries: %d", cache.Stats().Entries))
+}
+
+// breakDB points the driver at a port nothing is listening on
+func breakDB(mysql *mdns.MySQLDriver) {
+	mdns.Conf.DbConn = "root:password@tcp(127.0.0.1:3307)/designate"
+	mysql.Open()
+}
+
+func TestCacheServeStale(t *testing.T) {
+	SetUp()
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	cache := mdns.NewCachingDriver(mysql, 1<<20)
+	cache.ServeStale(time.Hour, 30)
+
+	rrs, err := cache.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	assert(t, rrs[0].Header().Ttl == 3600, fmt.Sprintf("TTL should be 3600, it was: %d", rrs[0].Header().Ttl))
+	_, err = cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+
+	cache.Invalidate("gomdns.com.")
+	assert(t, cache.Stats().Stale == 2, fmt.Sprintf("Wrong number of stale entries: %d", cache.Stats().Stale))
+	breakDB(mysql)
+
+	rrs, err = cache.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	assert(t, rrs[0].Header().Ttl == 30, fmt.Sprintf("Stale TTL should be 30, it was: %d", rrs[0].Header().Ttl))
+
+	rrs, err = cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	assert(t, len(rrs) == 3, fmt.Sprintf("Wrong number of records: %d", len(rrs)))
+	assert(t, rrs[0].Header().Ttl == 3600, "Stale AXFRs shouldn't have their TTLs changed")
+}
+
+func TestCacheServeStaleTooOld(t *testing.T) {
+	SetUp()
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	cache := mdns.NewCachingDriver(mysql, 1<<20)
+	cache.ServeStale(0, 30)
+
+	_, err := cache.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	cache.Invalidate("gomdns.com.")
+	breakDB(mysql)
+
+	_, err = cache.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	assert(t, err != nil, "Data older than the max staleness shouldn't be served")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"strings"
+
+	"github.com/rackerlabs/mdns"
+)
+
+// export writes zones from the Designate database as RFC 1035 zone files,
+// exactly as mdns would transfer them. It takes the same database flags as
+// mdns.
+func main() {
+	zones := flag.String("zones", "", "comma separated list of zones to export")
+	all := flag.Bool("all", false, "export every zone in the pool")
+	tasks := flag.Bool("tasks", false, "process the pending EXPORT zone_tasks, setting their status and location")
+	dir := flag.String("dir", ".", "directory to write the zone files to")
+	mdns.InitConfig()
+	mdns.InitLogging()
+
+	names := []string{}
+	for _, name := range strings.Split(*zones, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && !*all && !*tasks {
+		fmt.Fprintln(os.Stderr, "Nothing to export, give -zones, -all or -tasks")
+		os.Exit(2)
+	}
+	if len(names) > 0 && *all {
+		fmt.Fprintln(os.Stderr, "Give either -zones or -all, not both")
+		os.Exit(2)
+	}
+
+	mysql := &mdns.MySQLDriver{}
+	if err := mysql.Open(); err != nil {
+		log.Fatal(fmt.Sprintf("Couldn't connect to database : %s", err))
+	}
+	defer mysql.Close()
+	ctx := mdns.WithLogger(context.Background(), log.WithField("tool", "export"))
+
+	if *all {
+		var err error
+		names, err = mdns.ZoneNames(ctx, mysql)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Couldn't list the zones in the pool : %s", err))
+		}
+	}
+
+	failed := 0
+	for _, name := range names {
+		path, err := mdns.ExportZone(ctx, mysql, name, *dir)
+		if err != nil {
+			log.Error(fmt.Sprintf("Couldn't export %s : %s", name, err))
+			failed++
+			continue
+		}
+		log.Info(fmt.Sprintf("Exported %s to %s", name, path))
+	}
+
+	if *tasks {
+		completed, err := mdns.ProcessExportTasks(ctx, mysql, mysql, *dir)
+		if err != nil {
+			log.Error(fmt.Sprintf("Couldn't process export tasks : %s", err))
+			failed++
+		}
+		log.Info(fmt.Sprintf("Completed %d export tasks", completed))
+	}
+
+	if failed > 0 {
+		log.Error(fmt.Sprintf("%d exports failed", failed))
+		os.Exit(1)
+	}
+}
@@ -24,19 +24,126 @@ func main() {
 	// Logging
 	mdns.InitLogging()
 
-	// Database
-	mysql := &mdns.MySQLDriver{}
-	err := mysql.Open()
-	if err != nil {
-		log.Fatal(fmt.Sprintf("Couldn't connect to database : %s", err))
-		os.Exit(1)
+	if err := run(conf); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves until mdns is told to stop, or fails. Everything it starts is
+// stopped before it returns, so the cache gets to write its last snapshot.
+func run(conf mdns.Config) error {
+	// Database, or zone files
+	var dbErr error
+	var dbFailed <-chan error
+	storage := mdns.Storage{}
+	reload := []func(){}
+	snapshotZones := 0
+	if conf.ZoneDir != "" {
+		files := mdns.NewZoneFileDriver(conf.ZoneDir)
+		dbErr = files.Open()
+		files.StartWatching(conf.ZoneDirInterval)
+		defer files.Stop()
+		storage.Driver = files
+		if conf.Secondary {
+			log.Warn("-secondary has no effect with -zone_dir")
+		}
+	} else {
+		mysql := &mdns.MySQLDriver{}
+		dbErr = mysql.Open()
+		dbFailed = mysql.Failed()
+		storage.Driver = mysql
+
+		// Secondary zones
+		if conf.Secondary {
+			secondary := mdns.NewSecondaryDriver(mysql, mysql)
+			secondary.Start(conf.SecondaryInterval)
+			defer secondary.Stop()
+			storage.Driver = secondary
+		}
+	}
+
+	// Cache
+	var cache *mdns.CachingDriver
+	if conf.Cache {
+		cache = mdns.NewCachingDriver(storage.Driver, conf.CacheMaxBytes)
+		if conf.ServeStale {
+			cache.ServeStale(conf.ServeStaleMaxAge, uint32(conf.ServeStaleTtl))
+		} else {
+			cache.StaleLimits(conf.ServeStaleMaxAge, uint32(conf.ServeStaleTtl))
+		}
+		if conf.SnapshotPath != "" {
+			var err error
+			snapshotZones, err = cache.LoadSnapshot(conf.SnapshotPath)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Couldn't load snapshot %s : %s", conf.SnapshotPath, err))
+			} else {
+				log.Info(fmt.Sprintf("Loaded %d zones from snapshot %s", snapshotZones, conf.SnapshotPath))
+			}
+		}
+		storage.Driver = cache
+		reload = append(reload, cache.Flush)
+	} else if conf.ServeStale || conf.SnapshotPath != "" {
+		log.Warn("-serve_stale and -snapshot_path have no effect without -cache")
+	}
+
+	select {
+	case err := <-dbFailed:
+		return fmt.Errorf("Can't serve from the database : %s", err)
+	default:
+	}
+	if dbErr != nil && snapshotZones == 0 {
+		return fmt.Errorf("Couldn't connect to database : %s", dbErr)
+	} else if dbErr != nil {
+		log.Warn(fmt.Sprintf("Couldn't connect to database, serving from the snapshot : %s", dbErr))
+	}
+
+	// Only once mdns is going to serve, so the snapshot isn't overwritten
+	// with an empty cache
+	if cache != nil {
+		if conf.SnapshotPath != "" {
+			cache.StartSnapshots(conf.SnapshotPath, conf.SnapshotInterval)
+		}
+		cache.StartPolling(conf.CachePollInterval)
+		defer cache.Stop()
+	}
+	if conf.AxfrCacheMaxBytes > 0 {
+		storage.AxfrCache = mdns.NewAxfrCache(conf.AxfrCacheMaxBytes)
+		reload = append(reload, storage.AxfrCache.Flush)
 	}
-	storage := mdns.Storage{Driver: mysql}
 
 	handler := mdns.NewDefaultMdnsHandler(storage)
 
+	// dnstap
+	if conf.DnstapSocket != "" || conf.DnstapFile != "" {
+		tap, err := mdns.OpenTapper(conf.DnstapSocket, conf.DnstapFile, conf.DnstapBuffer)
+		if err != nil {
+			return err
+		}
+		defer tap.Close()
+		handler.SetTapper(tap)
+	}
+
 	// Listeners
-	go mdns.Serve("tcp", conf.BindAddress, conf.BindPort, handler)
-	go mdns.Serve("udp", conf.BindAddress, conf.BindPort, handler)
-	mdns.Listen()
+	listeners, err := mdns.Serve(conf.Listen, handler)
+	if err != nil {
+		return err
+	}
+	// The schema is read late if the database was down at startup, and one
+	// mdns can't serve stops it then too
+	if dbFailed != nil {
+		go func() {
+			err := <-dbFailed
+			listeners.Errors <- fmt.Errorf("Can't serve from the database : %s", err)
+		}()
+	}
+
+	// Metrics and health checks
+	if conf.HttpAddress != "" {
+		health := &mdns.HealthChecker{Storage: storage, Listeners: listeners, CanaryZone: conf.CanaryZone}
+		_, err = mdns.StartHTTP(conf.HttpAddress, health)
+		if err != nil {
+			return err
+		}
+	}
+	return mdns.Listen(listeners, reload...)
 }
@@ -1,6 +1,7 @@
 package mdns
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -8,7 +9,10 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 	"strings"
+	"sync"
+	"time"
 )
 
 //
@@ -16,22 +20,52 @@ import (
 //
 
 type Storage struct {
-	Driver interface {
-		Open() error
-		GetFullAxfrRRs(string) ([]dns.RR, error)
-		getZone(string) (Zone, error)
-		getRawAxfrRRs(Zone) ([]dns.RR, error)
-		GetQueryRRs(string, string) ([]dns.RR, error)
-	}
+	Driver    Driver
+	AxfrCache *AxfrCache
+}
+
+// Driver is where mdns reads zones from. Drivers can wrap one another, like
+// CachingDriver, and can be written outside this package.
+type Driver interface {
+	Open() error
+	Ping(context.Context) error
+	GetFullAxfrRRs(context.Context, string) ([]dns.RR, error)
+	FindZone(context.Context, string) (Zone, error)
+	GetQueryRRs(context.Context, string, string) ([]dns.RR, error)
+	GetZoneSerials(context.Context) (map[string]uint32, error)
 }
 
+// MySQLDriver reads from the healthy replicas in turn, falling back to the
+// primary when there are none.
 type MySQLDriver struct {
-	db *sqlx.DB
+	primary  *dbEndpoint
+	replicas []*dbEndpoint
+	// schema is nil until it has been read from an endpoint, and schemaErr
+	// is set, and sent on failed, if mdns can't serve it
+	schemaMutex sync.RWMutex
+	schema      *schema
+	schemaErr   error
+	failed      chan error
+	next        uint32
+	ejectAfter  int
+	stop        chan struct{}
+	lookups     singleflight.Group
 }
 
 type Zone struct {
-	Id  string
-	Ttl int64
+	Id      string
+	Name    string
+	Ttl     int64
+	Status  string
+	Action  string
+	PoolId  string `db:"pool_id"`
+	Serial  uint32
+	Email   string
+	Refresh int64
+	Retry   int64
+	Expire  int64
+	Minimum int64
+	Shard   int
 }
 
 type RR struct {
@@ -40,6 +74,7 @@ type RR struct {
 	Ttl        sql.NullInt64
 	Name       string
 	Data       string
+	Status     string
 	Action     string
 	Created_at string
 }
@@ -49,137 +84,349 @@ type RR struct {
 //
 
 func (mysql *MySQLDriver) Open() error {
-	var err error
-	mysql.db, err = sqlx.Open(Conf.DbType, Conf.DbConn)
-	if err != nil {
-		log.Error(fmt.Sprintf("Problem connecting to Database: %s", err))
-		return err
-	}
-	// Don't defer db.Close() because we're using the db obj
-	err = mysql.db.Ping()
+	statsDriver.Lock()
+	statsDriver.driver = mysql
+	statsDriver.Unlock()
+
+	err := mysql.openEndpoints()
 	if err != nil {
-		log.Error("Unsuccesful Ping to DB")
 		return err
 	}
-	log.Info("Connected to the DB!")
-
+	log.Info(fmt.Sprintf("Connected to the DB! (%d replicas, %s schema)", len(mysql.replicas), mysql.Schema()))
 	return nil
 }
 
-func (mysql *MySQLDriver) GetFullAxfrRRs(zonename string) ([]dns.RR, error) {
-	zone, err := mysql.getZone(zonename)
-	if err != nil {
-		return nil, err
+// Schema returns the name of the Designate schema generation in use, zones or
+// domains, once it has been read from the database.
+func (mysql *MySQLDriver) Schema() string {
+	mysql.schemaMutex.RLock()
+	defer mysql.schemaMutex.RUnlock()
+	if mysql.schema == nil {
+		return ""
 	}
-	rrs, err := mysql.getRawAxfrRRs(zone)
-	if err != nil {
-		return nil, err
+	return mysql.schema.Name
+}
+
+// names is the schema in use, or the current one if it isn't known yet.
+func (mysql *MySQLDriver) names() *schema {
+	mysql.schemaMutex.RLock()
+	defer mysql.schemaMutex.RUnlock()
+	if mysql.schema == nil {
+		return schemas[len(schemas)-1]
+	}
+	return mysql.schema
+}
+
+// Ping succeeds if any endpoint mdns would read from answers.
+func (mysql *MySQLDriver) Ping(ctx context.Context) error {
+	return mysql.read(ctx, func(db *sqlx.DB) error {
+		return db.PingContext(ctx)
+	})
+}
+
+// coalesce runs fetch once for every concurrent caller using the same key,
+// and hands all of them its result. The RRs are shared, so callers must not
+// modify them. fetch doesn't run under any one caller's deadline, since the
+// others may have longer; it keeps the first caller's values and gets timeout
+// of its own. Each caller stops waiting for it when its own context is done.
+func (mysql *MySQLDriver) coalesce(ctx context.Context, key string, timeout time.Duration, fetch func(context.Context) ([]dns.RR, error)) ([]dns.RR, error) {
+	results := mysql.lookups.DoChan(key, func() (interface{}, error) {
+		fetchCtx, cancel := withTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+		return fetch(fetchCtx)
+	})
+	select {
+	case result := <-results:
+		if result.Shared {
+			dbCoalesced.Inc()
+		}
+		rrs, _ := result.Val.([]dns.RR)
+		return rrs, result.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return rrs, nil
 }
 
-func (mysql *MySQLDriver) getZone(zonename string) (Zone, error) {
+func (mysql *MySQLDriver) GetFullAxfrRRs(ctx context.Context, zonename string) ([]dns.RR, error) {
+	return mysql.coalesce(ctx, "axfr:"+strings.ToLower(zonename), Conf.AxfrTimeout, func(ctx context.Context) ([]dns.RR, error) {
+		zone, err := mysql.getZone(ctx, zonename)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkZone(ctx, zone, "AXFR of "+zonename); err != nil {
+			return nil, err
+		}
+		rrs, err := mysql.getRawAxfrRRs(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+		return rrs, nil
+	})
+}
+
+func (mysql *MySQLDriver) getZone(ctx context.Context, zonename string) (Zone, error) {
 	zone := Zone{}
-	row := mysql.db.QueryRowx(
-		`SELECT zones.id, zones.ttl
-	       FROM zones
-	       WHERE zones.name = ?
-	       AND zones.pool_id = '794ccc2cd75144feb57f8894c9f5c842'
-	       AND zones.deleted = '0'`, zonename)
-	err := row.StructScan(&zone)
+	err := mysql.read(ctx, func(db *sqlx.DB) error {
+		start := time.Now()
+		row := db.QueryRowxContext(ctx, fmt.Sprintf(
+			`SELECT %s
+		       FROM %s AS zones
+		       WHERE zones.name = ?
+		       AND zones.pool_id = '794ccc2cd75144feb57f8894c9f5c842'
+		       AND zones.deleted = '0'`, mysql.names().zoneColumns(), mysql.names().ZoneTable), zonename)
+		err := row.StructScan(&zone)
+		if err == sql.ErrNoRows {
+			observeDBQuery("zone", start, nil)
+		} else {
+			observeDBQuery("zone", start, err)
+		}
+		return err
+	})
+	if err == sql.ErrNoRows {
+		LoggerFrom(ctx).Debug(fmt.Sprintf("No zone %s", zonename))
+		return zone, err
+	}
 	if err != nil {
-		log.Error(fmt.Sprintf("Error fetching zone %s: %s", zonename, err))
+		LoggerFrom(ctx).Error(fmt.Sprintf("Error fetching zone %s: %s", zonename, err))
 		return zone, err
 	}
 
 	return zone, err
 }
 
-func (mysql *MySQLDriver) getRawAxfrRRs(zone Zone) ([]dns.RR, error) {
-	var rrs []RR
-	query := `SELECT recordsets.id, recordsets.type, recordsets.ttl, recordsets.name, recordsets.created_at, records.data, records.action
-	       FROM records
-	       INNER JOIN recordsets ON records.recordset_id = recordsets.id
-	       WHERE records.action != 'DELETE'
-	       AND recordsets.zone_id = ?
-	       ORDER BY recordsets.created_at`
+// FindZone returns the closest zone enclosing qname, in one indexed query.
+// Each zone's reverse_name is its name spelt backwards, so the zones that
+// could enclose qname are the ones whose reverse_name is the reverse of one
+// of qname's suffixes. sql.ErrNoRows is returned if none do. Zones in every
+// shard are looked at, so that a child zone in a shard mdns doesn't serve is
+// refused, rather than answered from its parent.
+func (mysql *MySQLDriver) FindZone(ctx context.Context, qname string) (Zone, error) {
+	candidates := []interface{}{}
+	for _, suffix := range nameSuffixes(qname) {
+		candidates = append(candidates, reverseName(suffix))
+	}
+	if len(candidates) == 0 {
+		return Zone{}, sql.ErrNoRows
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(candidates)), ", ")
 
-	rows, err := mysql.db.Queryx(query, zone.Id)
+	zone := Zone{}
+	err := mysql.read(ctx, func(db *sqlx.DB) error {
+		start := time.Now()
+		row := db.QueryRowxContext(ctx, fmt.Sprintf(
+			`SELECT %s
+		       FROM %s AS zones
+		       WHERE zones.reverse_name IN (%s)
+		       AND zones.pool_id = '794ccc2cd75144feb57f8894c9f5c842'
+		       AND zones.deleted = '0'
+		       ORDER BY LENGTH(zones.reverse_name) DESC
+		       LIMIT 1`, mysql.names().zoneColumns(), mysql.names().ZoneTable, placeholders), candidates...)
+		err := row.StructScan(&zone)
+		if err == sql.ErrNoRows {
+			observeDBQuery("find_zone", start, nil)
+		} else {
+			observeDBQuery("find_zone", start, err)
+		}
+		return err
+	})
+	if err != nil && err != sql.ErrNoRows {
+		LoggerFrom(ctx).Error(fmt.Sprintf("Error finding the zone for %s: %s", qname, err))
+	}
+	return zone, err
+}
+
+// nameSuffixes returns name and each of its parents, lower cased, leaving
+// out the root. e.g. www.example.com. gives www.example.com., example.com.
+// and com.
+func nameSuffixes(name string) []string {
+	name = strings.ToLower(dns.Fqdn(name))
+	suffixes := []string{}
+	for _, i := range dns.Split(name) {
+		suffixes = append(suffixes, name[i:])
+	}
+	return suffixes
+}
+
+// reverseName spells name backwards, the way Designate fills reverse_name.
+func reverseName(name string) string {
+	runes := []rune(name)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// GetZoneSerials returns the current serial of every zone mdns serves. Zones
+// the status policy refuses are left out, so that a zone going into ERROR
+// drops out of the cache like a deleted one, as are zones in shards outside
+// -shards.
+func (mysql *MySQLDriver) GetZoneSerials(ctx context.Context) (map[string]uint32, error) {
+	logger := LoggerFrom(ctx)
+	var serials map[string]uint32
+	query := fmt.Sprintf(
+		`SELECT zones.name, zones.serial, zones.status, zones.action
+		       FROM %s AS zones
+		       WHERE zones.pool_id = '794ccc2cd75144feb57f8894c9f5c842'
+		       AND zones.deleted = '0'`, mysql.names().ZoneTable)
+	filter, args := shardFilter()
+	query += filter
+	err := mysql.read(ctx, func(db *sqlx.DB) error {
+		start := time.Now()
+		rows, err := db.QueryxContext(ctx, query, args...)
+		if err != nil {
+			observeDBQuery("zone_serials", start, err)
+			logger.Error("Error fetching zone serials: ", err)
+			return err
+		}
+		defer rows.Close()
+
+		policy := currentPolicy()
+		serials = map[string]uint32{}
+		for rows.Next() {
+			var name, status, action string
+			var serial uint32
+			err := rows.Scan(&name, &serial, &status, &action)
+			if err != nil {
+				observeDBQuery("zone_serials", start, err)
+				logger.Error("Error parsing zone serial rows: ", err)
+				return err
+			}
+			if policy.ZoneVerdict(status, action) == VerdictRefuse {
+				continue
+			}
+			serials[strings.ToLower(name)] = serial
+		}
+		err = rows.Err()
+		observeDBQuery("zone_serials", start, err)
+		if err != nil {
+			logger.Error("Error with zone serial rows: ", err)
+		}
+		return err
+	})
 	if err != nil {
-		log.Error("Error fetching records: ", err)
 		return nil, err
 	}
-	defer rows.Close()
+	return serials, nil
+}
 
-	for rows.Next() {
-		rr := RR{}
-		err := rows.StructScan(&rr)
+// queryRRs runs a records query and scans every row, observing it as name.
+func (mysql *MySQLDriver) queryRRs(ctx context.Context, name string, query string, args ...interface{}) ([]RR, error) {
+	logger := LoggerFrom(ctx)
+	var rrs []RR
+	err := mysql.read(ctx, func(db *sqlx.DB) error {
+		rrs = nil
+		start := time.Now()
+		rows, err := db.QueryxContext(ctx, query, args...)
 		if err != nil {
-			log.Error("Error parsing rr rows: ", err)
-			return nil, err
+			observeDBQuery(name, start, err)
+			logger.Error("Error fetching records: ", err)
+			return err
 		}
-		rrs = append(rrs, rr)
+		defer rows.Close()
+
+		for rows.Next() {
+			rr := RR{}
+			err := rows.StructScan(&rr)
+			if err != nil {
+				observeDBQuery(name, start, err)
+				logger.Error("Error parsing rr rows: ", err)
+				return err
+			}
+			rrs = append(rrs, rr)
+		}
+		err = rows.Err()
+		observeDBQuery(name, start, err)
+		if err != nil {
+			logger.Error("Error with rr rows: ", err)
+		}
+		return err
+	})
+	return rrs, err
+}
+
+func (mysql *MySQLDriver) getRawAxfrRRs(ctx context.Context, zone Zone) ([]dns.RR, error) {
+	query := fmt.Sprintf(`SELECT records.id, recordsets.type, recordsets.ttl, recordsets.name, recordsets.created_at, records.data, records.status, records.action
+	       FROM records
+	       INNER JOIN recordsets ON records.recordset_id = recordsets.id
+	       WHERE recordsets.%s = ?
+	       ORDER BY recordsets.created_at`, mysql.names().ZoneIdColumn)
+
+	rrs, err := mysql.queryRRs(ctx, "axfr_records", query, zone.Id)
+	if err != nil {
+		return nil, err
 	}
-	err = rows.Err()
+	rrs = currentPolicy().filterRecords(rrs)
+	rrs, err = mysql.synthesizeApex(ctx, zone, "AXFR", rrs)
 	if err != nil {
-		log.Error("Error with rr rows: ", err)
 		return nil, err
 	}
 
 	dnsRRs, err := BuildDnsRRs(rrs, zone, true)
 	if err != nil {
-		log.Error("Error creating DNS RRs: ", err)
+		LoggerFrom(ctx).Error("Error creating DNS RRs: ", err)
 		return dnsRRs, err
 	}
-	return dnsRRs, err
+	return spfAsTxt(dnsRRs, "AXFR"), err
 }
 
-func (mysql *MySQLDriver) GetQueryRRs(RRName string, RRType string) ([]dns.RR, error) {
-	var rrs []RR
-	query := []string{`SELECT recordsets.id, recordsets.type, recordsets.ttl, recordsets.name, recordsets.created_at, records.data, records.action
+func (mysql *MySQLDriver) GetQueryRRs(ctx context.Context, RRName string, RRType string) ([]dns.RR, error) {
+	return mysql.coalesce(ctx, "query:"+strings.ToLower(RRName)+"/"+RRType, Conf.QueryTimeout, func(ctx context.Context) ([]dns.RR, error) {
+		return mysql.getQueryRRs(ctx, RRName, RRType)
+	})
+}
+
+// getQueryRRs answers from the zone that encloses RRName, so a name that is
+// both a delegation in the parent and the apex of a child zone is answered
+// from the child.
+func (mysql *MySQLDriver) getQueryRRs(ctx context.Context, RRName string, RRType string) ([]dns.RR, error) {
+	zone, err := mysql.FindZone(ctx, RRName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkZone(ctx, zone, fmt.Sprintf("%s query for %s", RRType, RRName)); err != nil {
+		return nil, err
+	}
+
+	query := []string{fmt.Sprintf(`SELECT records.id, recordsets.type, recordsets.ttl, recordsets.name, recordsets.created_at, records.data, records.status, records.action
 	       FROM records
 	       INNER JOIN recordsets ON records.recordset_id = recordsets.id
-	       WHERE records.action != 'DELETE'
-	       AND recordsets.name = ?`}
+	       WHERE recordsets.%s = ?
+	       AND recordsets.name = ?`, mysql.names().ZoneIdColumn)}
 
-	if RRType != "ANY" {
+	if RRType == "TXT" && Conf.SpfAsTxt {
+		query = append(query, "\n\t\tAND recordsets.type IN ('TXT', 'SPF')")
+	} else if RRType != "ANY" {
 		query = append(query, fmt.Sprintf("\n\t\tAND recordsets.type = '%s'", RRType))
 	}
 
 	queryx := strings.Join(query, "")
-	rows, err := mysql.db.Queryx(queryx, RRName)
+	rrs, err := mysql.queryRRs(ctx, "query_records", queryx, zone.Id, RRName)
 	if err != nil {
-		log.Error("Error querying rrs: ", err)
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		rr := RR{}
-		err := rows.StructScan(&rr)
+	rrs = currentPolicy().filterRecords(rrs)
+	if strings.EqualFold(RRName, zone.Name) {
+		rrs, err = mysql.synthesizeApex(ctx, zone, RRType, rrs)
 		if err != nil {
-			log.Error("Error parsing rrs: ", err)
 			return nil, err
 		}
-		rrs = append(rrs, rr)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.Error("error with rr rows: ", err)
-		return nil, err
 	}
 
-	// TODO: Go get the actual zone TTL
-	zone := Zone{Id: "notarealzone", Ttl: 3600}
 	DnsRRs, err := BuildDnsRRs(rrs, zone, false)
 	if err != nil {
-		log.Error("Error creating DNS RRs: ", err)
+		LoggerFrom(ctx).Error("Error creating DNS RRs: ", err)
 		return DnsRRs, err
 	}
 
-	return DnsRRs, err
+	return spfAsTxt(DnsRRs, RRType), err
 }
 
+// BuildDnsRRs turns rows into records, with the SOA on both ends for an
+// AXFR. A row whose data doesn't make a record is skipped, or fails the
+// whole lot with -strict_records.
 func BuildDnsRRs(rrs []RR, zone Zone, axfr bool) ([]dns.RR, error) {
 	// This could be suck inside the loop iterating the
 	// DB rows, but this is much nicer. Even if it is a bit slower.
@@ -187,21 +434,14 @@ func BuildDnsRRs(rrs []RR, zone Zone, axfr bool) ([]dns.RR, error) {
 	var SoaRecord dns.RR
 
 	for _, rr := range rrs {
-		var ttl int64
-		if rr.Ttl.Valid {
-			ttl = rr.Ttl.Int64
-		} else {
-			ttl = zone.Ttl
-		}
-
-		record := fmt.Sprintf("%s %d IN %s %s", rr.Name, ttl, rr.Rrtype, rr.Data)
-		DnsRR, err := dns.NewRR(record)
+		DnsRR, err := buildRR(rr, zone)
 		if err != nil {
-			log.Error(fmt.Sprintf("Error parsing record %s: %s", record, err))
-			return DnsRRs, err
+			if err := badRecord(rr, zone, err); err != nil {
+				return DnsRRs, err
+			}
+			continue
 		}
 
-		log.Debug(fmt.Sprintf("Processed record %s", record))
 		if rr.Rrtype != "SOA" || axfr == false {
 			DnsRRs = append(DnsRRs, DnsRR)
 		} else {
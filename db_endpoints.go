@@ -0,0 +1,398 @@
+package mdns
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Database Endpoints
+//
+
+// dbEndpoint is one database mdns can read from: the primary or a replica.
+// An endpoint is ejected after enough consecutive connection failures, and
+// only comes back once the pinger reaches it again.
+type dbEndpoint struct {
+	name     string
+	db       *sqlx.DB
+	mutex    sync.Mutex
+	healthy  bool
+	failures int
+}
+
+// EndpointStatus describes one database endpoint, for tests and reporting.
+type EndpointStatus struct {
+	Name    string
+	Healthy bool
+	Stats   sql.DBStats
+}
+
+func openEndpoint(name string, dsn string) (*dbEndpoint, error) {
+	db, err := sqlx.Open(Conf.DbType, dsn)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(db)
+	dbEndpointHealthy.WithLabelValues(name).Set(1)
+	return &dbEndpoint{name: name, db: db, healthy: true}, nil
+}
+
+// configurePool applies the pool settings from Conf. A setting of 0 leaves
+// database/sql's default in place.
+func configurePool(db *sqlx.DB) {
+	if Conf.DbMaxOpenConns > 0 {
+		db.SetMaxOpenConns(Conf.DbMaxOpenConns)
+	}
+	if Conf.DbMaxIdleConns > 0 {
+		db.SetMaxIdleConns(Conf.DbMaxIdleConns)
+	}
+	if Conf.DbConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(Conf.DbConnMaxLifetime)
+	}
+	if Conf.DbConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(Conf.DbConnMaxIdleTime)
+	}
+}
+
+func (ep *dbEndpoint) Healthy() bool {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	return ep.healthy
+}
+
+func (ep *dbEndpoint) succeeded() {
+	ep.mutex.Lock()
+	ep.failures = 0
+	ep.mutex.Unlock()
+}
+
+func (ep *dbEndpoint) failed(err error, ejectAfter int) {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	ep.failures++
+	if !ep.healthy || ep.failures < ejectAfter {
+		return
+	}
+	ep.healthy = false
+	dbEndpointHealthy.WithLabelValues(ep.name).Set(0)
+	dbEndpointEjections.WithLabelValues(ep.name).Inc()
+	log.Warn(fmt.Sprintf("Ejecting database endpoint %s after %d errors, last: %s", ep.name, ep.failures, err))
+}
+
+func (ep *dbEndpoint) eject(err error) {
+	ep.failed(err, 0)
+}
+
+func (ep *dbEndpoint) restore() {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	if ep.healthy {
+		return
+	}
+	ep.healthy = true
+	ep.failures = 0
+	dbEndpointHealthy.WithLabelValues(ep.name).Set(1)
+	log.Info(fmt.Sprintf("Database endpoint %s is reachable again", ep.name))
+}
+
+// endpointFailure reports whether err means the endpoint itself is in
+// trouble. A missing row, or an error the server sent back about the query,
+// says nothing about whether the next query there will work.
+func endpointFailure(err error) bool {
+	if err == nil || err == sql.ErrNoRows {
+		return false
+	}
+	var serverErr *mysqldriver.MySQLError
+	return !errors.As(err, &serverErr)
+}
+
+// openEndpoints connects to the primary in Conf.DbConn and to every replica
+// in Conf.DbReplicas. An endpoint that can't be reached starts out ejected,
+// and the pinger brings it back. The schema is read from the first endpoint
+// that answers, and until one does reads are refused and the error is
+// returned, so mdns can still start from a snapshot. A schema mdns can't
+// serve fails the startup.
+func (mysql *MySQLDriver) openEndpoints() error {
+	mysql.Close()
+	mysql.ejectAfter = Conf.DbEjectErrors
+	if mysql.ejectAfter < 1 {
+		mysql.ejectAfter = 1
+	}
+	mysql.schemaMutex.Lock()
+	mysql.schema, mysql.schemaErr = nil, nil
+	mysql.failed = make(chan error, 1)
+	mysql.schemaMutex.Unlock()
+
+	primary, err := openEndpoint("primary", Conf.DbConn)
+	if err != nil {
+		log.Error(fmt.Sprintf("Problem connecting to Database: %s", err))
+		return err
+	}
+	mysql.primary = primary
+	mysql.replicas = nil
+	// Don't defer db.Close() because we're using the db obj
+	if err := primary.db.Ping(); err != nil {
+		log.Error(fmt.Sprintf("Unsuccesful Ping to DB: %s", err))
+		primary.eject(err)
+	}
+
+	for i, dsn := range Conf.DbReplicas {
+		replica, err := openEndpoint(fmt.Sprintf("replica%d", i), dsn)
+		if err != nil {
+			log.Error(fmt.Sprintf("Problem connecting to replica %d: %s", i, err))
+			return err
+		}
+		if err := replica.db.Ping(); err != nil {
+			replica.eject(err)
+		}
+		mysql.replicas = append(mysql.replicas, replica)
+	}
+
+	err = mysql.readSchema(context.Background())
+	if mysql.schemaFailed() {
+		mysql.Close()
+		return err
+	}
+	if Conf.DbPingInterval > 0 {
+		mysql.stop = make(chan struct{})
+		go mysql.pingEjected(Conf.DbPingInterval, mysql.stop)
+	}
+	return err
+}
+
+// readSchema reads the schema version from the first endpoint that answers,
+// and checks -shards against it. It does nothing once the schema is known,
+// or found to be one mdns can't serve.
+func (mysql *MySQLDriver) readSchema(ctx context.Context) error {
+	mysql.schemaMutex.Lock()
+	defer mysql.schemaMutex.Unlock()
+	if mysql.schema != nil || mysql.schemaErr != nil {
+		return mysql.schemaErr
+	}
+
+	err := errors.New("no database endpoints")
+	for _, ep := range mysql.endpoints() {
+		var version int
+		version, err = schemaVersion(ctx, ep.db)
+		if err != nil {
+			continue
+		}
+		names, err := schemaForVersion(version)
+		if err == nil && Conf.Shards != nil && !names.Sharded {
+			err = fmt.Errorf("-shards needs a sharded schema, the %s schema has no shard column", names.Name)
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("Problem with the Database: %s", err))
+			mysql.schemaErr = err
+			select {
+			case mysql.failed <- err:
+			default:
+			}
+			return err
+		}
+		mysql.schema = names
+		return nil
+	}
+	log.Error(fmt.Sprintf("Couldn't read the schema from any database endpoint, last: %s", err))
+	return err
+}
+
+// Failed receives the error if the schema turns out to be one mdns can't
+// serve, which can happen after Open when the database was down at first.
+// mdns can't serve anything from the database after that, so it should stop,
+// as it would have at startup.
+func (mysql *MySQLDriver) Failed() <-chan error {
+	mysql.schemaMutex.RLock()
+	defer mysql.schemaMutex.RUnlock()
+	return mysql.failed
+}
+
+func (mysql *MySQLDriver) schemaFailed() bool {
+	mysql.schemaMutex.RLock()
+	defer mysql.schemaMutex.RUnlock()
+	return mysql.schemaErr != nil
+}
+
+// schemaReady returns nil once the schema is known, and why reads are
+// refused until then.
+func (mysql *MySQLDriver) schemaReady() error {
+	mysql.schemaMutex.RLock()
+	defer mysql.schemaMutex.RUnlock()
+	if mysql.schemaErr != nil {
+		return mysql.schemaErr
+	}
+	if mysql.schema == nil {
+		return errors.New("the Designate schema hasn't been read from the database yet")
+	}
+	return nil
+}
+
+// endpoints returns the primary followed by the replicas.
+func (mysql *MySQLDriver) endpoints() []*dbEndpoint {
+	if mysql.primary == nil {
+		return nil
+	}
+	return append([]*dbEndpoint{mysql.primary}, mysql.replicas...)
+}
+
+// Endpoints reports the health of the primary and every replica.
+func (mysql *MySQLDriver) Endpoints() []EndpointStatus {
+	statuses := []EndpointStatus{}
+	for _, ep := range mysql.endpoints() {
+		statuses = append(statuses, EndpointStatus{Name: ep.name, Healthy: ep.Healthy(), Stats: ep.db.Stats()})
+	}
+	return statuses
+}
+
+// reader picks the next healthy replica that hasn't been tried, round
+// robin. The primary is only read from once no replica is left.
+func (mysql *MySQLDriver) reader(tried map[*dbEndpoint]bool) *dbEndpoint {
+	n := len(mysql.replicas)
+	if n > 0 {
+		first := int(atomic.AddUint32(&mysql.next, 1))
+		for i := 0; i < n; i++ {
+			replica := mysql.replicas[(first+i)%n]
+			if !tried[replica] && replica.Healthy() {
+				return replica
+			}
+		}
+	}
+	if !tried[mysql.primary] {
+		return mysql.primary
+	}
+	return nil
+}
+
+// read runs query against a reader, moving on to the next one whenever an
+// endpoint fails, so a dead replica costs a retry rather than an error. Once
+// ctx is done the context's error is returned, and no endpoint is blamed.
+func (mysql *MySQLDriver) read(ctx context.Context, query func(*sqlx.DB) error) error {
+	if mysql.primary == nil {
+		return errors.New("Database is not open")
+	}
+	if err := mysql.schemaReady(); err != nil {
+		return err
+	}
+	tried := map[*dbEndpoint]bool{}
+	var err error
+	for ep := mysql.reader(tried); ep != nil; ep = mysql.reader(tried) {
+		err = query(ep.db)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !endpointFailure(err) {
+			ep.succeeded()
+			return err
+		}
+		ep.failed(err, mysql.ejectAfter)
+		tried[ep] = true
+	}
+	return err
+}
+
+// write runs query against the primary, the only endpoint that takes
+// writes. Nothing is retried elsewhere.
+func (mysql *MySQLDriver) write(ctx context.Context, query func(*sqlx.DB) error) error {
+	if mysql.primary == nil {
+		return errors.New("Database is not open")
+	}
+	if err := mysql.schemaReady(); err != nil {
+		return err
+	}
+	err := query(mysql.primary.db)
+	if endpointFailure(err) && ctx.Err() == nil {
+		mysql.primary.failed(err, mysql.ejectAfter)
+	}
+	return err
+}
+
+// pingEjected pings every ejected endpoint each interval, restoring the ones
+// that answer. Until the schema is known, it tries to read it each time.
+func (mysql *MySQLDriver) pingEjected(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, ep := range mysql.endpoints() {
+				if ep.Healthy() {
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				if err := ep.db.PingContext(ctx); err == nil {
+					ep.restore()
+				}
+				cancel()
+			}
+			if mysql.schemaReady() != nil && !mysql.schemaFailed() {
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				if mysql.readSchema(ctx) == nil {
+					log.Info(fmt.Sprintf("Read the %s schema, database reads can start", mysql.Schema()))
+				}
+				cancel()
+			}
+		}
+	}
+}
+
+// Close stops the pinger and closes every endpoint.
+func (mysql *MySQLDriver) Close() {
+	if mysql.stop != nil {
+		close(mysql.stop)
+		mysql.stop = nil
+	}
+	for _, ep := range mysql.endpoints() {
+		ep.db.Close()
+	}
+}
+
+// The most recently opened driver, for reporting pool stats
+var statsDriver struct {
+	sync.Mutex
+	driver *MySQLDriver
+}
+
+// logPoolStats logs the pool stats of every endpoint.
+func logPoolStats() {
+	statsDriver.Lock()
+	defer statsDriver.Unlock()
+	if statsDriver.driver == nil {
+		return
+	}
+	for _, ep := range statsDriver.driver.endpoints() {
+		stats := ep.db.Stats()
+		log.Info(fmt.Sprintf("DB pool %s: open=%d/%d in_use=%d idle=%d waits=%d waited=%s closed_idle=%d closed_idle_time=%d closed_lifetime=%d",
+			ep.name, stats.OpenConnections, stats.MaxOpenConnections, stats.InUse, stats.Idle,
+			stats.WaitCount, stats.WaitDuration, stats.MaxIdleClosed, stats.MaxIdleTimeClosed, stats.MaxLifetimeClosed))
+	}
+}
+
+// dbStats adds up the pool stats of every endpoint.
+func dbStats() sql.DBStats {
+	statsDriver.Lock()
+	defer statsDriver.Unlock()
+	total := sql.DBStats{}
+	if statsDriver.driver == nil {
+		return total
+	}
+	for _, ep := range statsDriver.driver.endpoints() {
+		stats := ep.db.Stats()
+		total.MaxOpenConnections += stats.MaxOpenConnections
+		total.OpenConnections += stats.OpenConnections
+		total.InUse += stats.InUse
+		total.Idle += stats.Idle
+		total.WaitCount += stats.WaitCount
+		total.WaitDuration += stats.WaitDuration
+	}
+	return total
+}
@@ -0,0 +1,577 @@
+package mdns_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rackerlabs/mdns"
+)
+
+// fakeSQL is a database/sql driver with no records. Every query comes back
+// empty, apart from the schema version and any canned rows, unless the
+// endpoint (the DSN) has been marked down or slow.
+type fakeSQL struct {
+	mutex     sync.Mutex
+	down      map[string]bool
+	slow      map[string]time.Duration
+	versions  map[string]int
+	queries   map[string]int
+	cancelled map[string]int
+	last      map[string]string
+	canned    []cannedRows
+	execs     [][]driver.Value
+	execFail  []string
+}
+
+// cannedRows are returned, from every endpoint, for queries containing match.
+type cannedRows struct {
+	match   string
+	columns []string
+	values  [][]driver.Value
+}
+
+var fakeDB = &fakeSQL{
+	down:      map[string]bool{},
+	slow:      map[string]time.Duration{},
+	versions:  map[string]int{},
+	queries:   map[string]int{},
+	cancelled: map[string]int{},
+	last:      map[string]string{},
+}
+
+func init() {
+	sql.Register("mdns_fake", fakeDB)
+}
+
+func (f *fakeSQL) setDown(dsn string, down bool) {
+	f.mutex.Lock()
+	f.down[dsn] = down
+	f.mutex.Unlock()
+}
+
+func (f *fakeSQL) setSlow(dsn string, delay time.Duration) {
+	f.mutex.Lock()
+	f.slow[dsn] = delay
+	f.mutex.Unlock()
+}
+
+// wait delays a query on a slow endpoint, until the delay is up or ctx is
+// done, whichever comes first.
+func (f *fakeSQL) wait(ctx context.Context, dsn string) error {
+	f.mutex.Lock()
+	delay := f.slow[dsn]
+	f.mutex.Unlock()
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		f.mutex.Lock()
+		f.cancelled[dsn]++
+		f.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (f *fakeSQL) wasCancelled(dsn string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.cancelled[dsn]
+}
+
+func (f *fakeSQL) queried(dsn string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.queries[dsn]
+}
+
+// setVersion sets the migrate_version an endpoint reports, 86 by default.
+func (f *fakeSQL) setVersion(dsn string, version int) {
+	f.mutex.Lock()
+	f.versions[dsn] = version
+	f.mutex.Unlock()
+}
+
+// setRows makes queries containing match return values, until clearRows.
+func (f *fakeSQL) setRows(match string, columns []string, values ...[]driver.Value) {
+	f.mutex.Lock()
+	f.canned = append(f.canned, cannedRows{match: match, columns: columns, values: values})
+	f.mutex.Unlock()
+}
+
+// failExec makes statements whose arguments include all of values fail,
+// until clearRows.
+func (f *fakeSQL) failExec(values ...string) {
+	f.mutex.Lock()
+	f.execFail = values
+	f.mutex.Unlock()
+}
+
+// executed returns the arguments of every statement run since clearRows.
+func (f *fakeSQL) executed() [][]driver.Value {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.execs
+}
+
+// clearRows drops the canned rows, failing statements and executed
+// statements.
+func (f *fakeSQL) clearRows() {
+	f.mutex.Lock()
+	f.canned = nil
+	f.execs = nil
+	f.execFail = nil
+	f.mutex.Unlock()
+}
+
+func (f *fakeSQL) exec(args []driver.Value) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	matched := len(f.execFail) > 0
+	for _, value := range f.execFail {
+		found := false
+		for _, arg := range args {
+			found = found || arg == driver.Value(value)
+		}
+		matched = matched && found
+	}
+	if matched {
+		return errors.New("fake statement failed")
+	}
+	f.execs = append(f.execs, args)
+	return nil
+}
+
+func (f *fakeSQL) lastQuery(dsn string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.last[dsn]
+}
+
+func (f *fakeSQL) check(dsn string, query string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.down[dsn] {
+		return errors.New("fake endpoint " + dsn + " is down")
+	}
+	if query != "" && !strings.Contains(query, "migrate_version") {
+		f.queries[dsn]++
+		f.last[dsn] = query
+	}
+	return nil
+}
+
+func (f *fakeSQL) rows(dsn string, query string) driver.Rows {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !strings.Contains(query, "migrate_version") {
+		for _, canned := range f.canned {
+			if strings.Contains(query, canned.match) {
+				return &fakeRows{columns: canned.columns, values: canned.values}
+			}
+		}
+		return &fakeRows{}
+	}
+	version, ok := f.versions[dsn]
+	if !ok {
+		version = 86
+	}
+	return &fakeRows{columns: []string{"version"}, values: [][]driver.Value{{int64(version)}}}
+}
+
+func (f *fakeSQL) Open(dsn string) (driver.Conn, error) {
+	return &fakeConn{dsn: dsn}, nil
+}
+
+type fakeConn struct{ dsn string }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{dsn: c.dsn, query: query}, nil
+}
+func (c *fakeConn) Close() error                   { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)      { return nil, errors.New("not supported") }
+func (c *fakeConn) Ping(ctx context.Context) error { return fakeDB.check(c.dsn, "") }
+
+type fakeStmt struct {
+	dsn   string
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := fakeDB.check(s.dsn, s.query); err != nil {
+		return nil, err
+	}
+	if err := fakeDB.exec(args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := fakeDB.check(s.dsn, s.query); err != nil {
+		return nil, err
+	}
+	return fakeDB.rows(s.dsn, s.query), nil
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := fakeDB.wait(ctx, s.dsn); err != nil {
+		return nil, err
+	}
+	return s.Query(nil)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// openFake opens a MySQLDriver on the fake driver, with a primary and two
+// replicas named after the test.
+func openFake(t *testing.T, name string) (*mdns.MySQLDriver, string, []string) {
+	SetUp()
+	mdns.Conf.DbType = "mdns_fake"
+	mdns.Conf.DbConn = name + "-primary"
+	mdns.Conf.DbReplicas = []string{name + "-replica0", name + "-replica1"}
+	mdns.Conf.DbEjectErrors = 1
+	mdns.Conf.DbPingInterval = 10 * time.Millisecond
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	return mysql, mdns.Conf.DbConn, mdns.Conf.DbReplicas
+}
+
+func healthy(mysql *mdns.MySQLDriver) map[string]bool {
+	statuses := map[string]bool{}
+	for _, status := range mysql.Endpoints() {
+		statuses[status.Name] = status.Healthy
+	}
+	return statuses
+}
+
+func TestFailoverSpreadsReads(t *testing.T) {
+	mysql, primary, replicas := openFake(t, "spread")
+	defer mysql.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+		ok(t, err)
+	}
+
+	equals(t, 0, fakeDB.queried(primary))
+	equals(t, 2, fakeDB.queried(replicas[0]))
+	equals(t, 2, fakeDB.queried(replicas[1]))
+}
+
+func TestFailoverEjectsAndRestores(t *testing.T) {
+	mysql, primary, replicas := openFake(t, "eject")
+	defer mysql.Close()
+
+	fakeDB.setDown(replicas[0], true)
+	for i := 0; i < 4; i++ {
+		_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+		ok(t, err)
+	}
+	equals(t, map[string]bool{"primary": true, "replica0": false, "replica1": true}, healthy(mysql))
+	equals(t, 0, fakeDB.queried(primary))
+	equals(t, 4, fakeDB.queried(replicas[1]))
+
+	fakeDB.setDown(replicas[0], false)
+	deadline := time.Now().Add(2 * time.Second)
+	for !healthy(mysql)["replica0"] && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, healthy(mysql)["replica0"], "replica0 was not restored by the pinger")
+
+	for i := 0; i < 4; i++ {
+		_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+		ok(t, err)
+	}
+	equals(t, 2, fakeDB.queried(replicas[0]))
+}
+
+func TestFailoverToPrimary(t *testing.T) {
+	mysql, primary, replicas := openFake(t, "primary")
+	defer mysql.Close()
+
+	fakeDB.setDown(replicas[0], true)
+	fakeDB.setDown(replicas[1], true)
+	_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+	ok(t, err)
+	equals(t, 1, fakeDB.queried(primary))
+	ok(t, mysql.Ping(context.Background()))
+
+	fakeDB.setDown(primary, true)
+	_, err = mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+	assert(t, err != nil, "expected an error with every endpoint down")
+	assert(t, mysql.Ping(context.Background()) != nil, "expected Ping to fail with every endpoint down")
+}
+
+func TestFailoverReplicaDownAtOpen(t *testing.T) {
+	SetUp()
+	fakeDB.setDown("open-replica0", true)
+	mdns.Conf.DbType = "mdns_fake"
+	mdns.Conf.DbConn = "open-primary"
+	mdns.Conf.DbReplicas = []string{"open-replica0"}
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	defer mysql.Close()
+	equals(t, map[string]bool{"primary": true, "replica0": false}, healthy(mysql))
+
+	_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+	ok(t, err)
+	equals(t, 1, fakeDB.queried("open-primary"))
+}
+
+func TestFailoverCoalescedDeadline(t *testing.T) {
+	mysql, primary, replicas := openFake(t, "coalesce")
+	defer mysql.Close()
+	endpoints := append([]string{primary}, replicas...)
+	for _, dsn := range endpoints {
+		fakeDB.setSlow(dsn, 50*time.Millisecond)
+	}
+
+	// The first caller gives up early, which doesn't cut the lookup short
+	// for the second.
+	short, cancel := context.WithTimeout(mdns.NewRequestContext(), 10*time.Millisecond)
+	defer cancel()
+	errs := make(chan error)
+	go func() {
+		_, err := mysql.GetQueryRRs(short, "example.com.", "A")
+		errs <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	go func() {
+		_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+		errs <- err
+	}()
+
+	equals(t, context.DeadlineExceeded, <-errs)
+	ok(t, <-errs)
+	for _, dsn := range endpoints {
+		equals(t, 0, fakeDB.wasCancelled(dsn))
+	}
+	equals(t, map[string]bool{"primary": true, "replica0": true, "replica1": true}, healthy(mysql))
+}
+
+// openPool opens a MySQLDriver on the fake driver with just a primary, and
+// the pool flags set.
+func openPool(t *testing.T, name string) *mdns.MySQLDriver {
+	mdns.Conf.DbType = "mdns_fake"
+	mdns.Conf.DbConn = name
+	mdns.Conf.DbReplicas = nil
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	return mysql
+}
+
+func primaryStats(mysql *mdns.MySQLDriver) sql.DBStats {
+	return mysql.Endpoints()[0].Stats
+}
+
+func TestFailoverPoolSettings(t *testing.T) {
+	SetUp()
+	mdns.Conf.DbMaxOpenConns = 3
+	mdns.Conf.DbMaxIdleConns = 1
+	mdns.Conf.DbConnMaxLifetime = 50 * time.Millisecond
+	mysql := openPool(t, "pool")
+	defer mysql.Close()
+	equals(t, 3, primaryStats(mysql).MaxOpenConnections)
+
+	// Lookups for different names aren't coalesced, so 5 at once need 5
+	// connections, and have to wait for the 3 allowed
+	fakeDB.setSlow("pool", 20*time.Millisecond)
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), fmt.Sprintf("host%d.example.com.", i), "A")
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		ok(t, <-errs)
+	}
+	stats := primaryStats(mysql)
+	assert(t, stats.WaitCount > 0, "expected lookups to wait for a connection")
+	equals(t, 1, stats.Idle)
+	assert(t, stats.MaxIdleClosed > 0, "expected connections over -db_max_idle_conns to be closed")
+
+	// The idle connection is past -db_conn_max_lifetime by the next lookup
+	time.Sleep(60 * time.Millisecond)
+	fakeDB.setSlow("pool", 0)
+	_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+	ok(t, err)
+	assert(t, primaryStats(mysql).MaxLifetimeClosed > 0, "expected the connection to be closed at -db_conn_max_lifetime")
+}
+
+func TestFailoverPoolMaxIdleTime(t *testing.T) {
+	SetUp()
+	mdns.Conf.DbConnMaxIdleTime = 10 * time.Millisecond
+	mysql := openPool(t, "pool-idle")
+	defer mysql.Close()
+
+	_, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+	ok(t, err)
+	// database/sql checks idle connections once a second at most
+	deadline := time.Now().Add(3 * time.Second)
+	for primaryStats(mysql).MaxIdleTimeClosed == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	equals(t, int64(1), primaryStats(mysql).MaxIdleTimeClosed)
+	equals(t, 0, primaryStats(mysql).Idle)
+}
+
+// lockedBuffer collects log output written from any goroutine.
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestFailoverPoolStatsOnSignal(t *testing.T) {
+	SetUp()
+	mdns.Conf.DbMaxOpenConns = 7
+	mysql := openPool(t, "pool-stats")
+	defer mysql.Close()
+
+	output := &lockedBuffer{}
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+
+	// Keep SIGUSR1 from killing the test before Listen is waiting for it
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+
+	listeners := &mdns.Listeners{Errors: make(chan error, 1)}
+	done := make(chan error)
+	go func() { done <- mdns.Listen(listeners) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(output.String(), "DB pool primary: ") && time.Now().Before(deadline) {
+		ok(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+		time.Sleep(20 * time.Millisecond)
+	}
+	listeners.Errors <- errors.New("stop")
+	<-done
+
+	stats := primaryStats(mysql)
+	assert(t, strings.Contains(output.String(), fmt.Sprintf("DB pool primary: open=%d/7 in_use=0 idle=%d", stats.OpenConnections, stats.Idle)),
+		"pool stats were not logged: %s", output.String())
+}
+
+// openDown opens a MySQLDriver on the fake driver with every endpoint down,
+// as mdns does when it starts from a snapshot. Callers run SetUp first.
+func openDown(name string, version int) (*mdns.MySQLDriver, []string, error) {
+	endpoints := []string{name + "-primary", name + "-replica0"}
+	for _, dsn := range endpoints {
+		fakeDB.setDown(dsn, true)
+		fakeDB.setVersion(dsn, version)
+	}
+	mdns.Conf.DbType = "mdns_fake"
+	mdns.Conf.DbConn = endpoints[0]
+	mdns.Conf.DbReplicas = endpoints[1:]
+	mdns.Conf.DbPingInterval = 10 * time.Millisecond
+
+	mysql := &mdns.MySQLDriver{}
+	return mysql, endpoints, mysql.Open()
+}
+
+// waitForSchema waits for the pinger to read the schema.
+func waitForSchema(mysql *mdns.MySQLDriver) {
+	deadline := time.Now().Add(2 * time.Second)
+	for mysql.Schema() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailoverAllDownAtOpen(t *testing.T) {
+	SetUp()
+	mysql, endpoints, err := openDown("alldown", 75)
+	defer mysql.Close()
+	assert(t, err != nil, "expected Open to fail with every endpoint down")
+	equals(t, map[string]bool{"primary": false, "replica0": false}, healthy(mysql))
+
+	// Reads are refused until the schema is known
+	fakeDB.setDown(endpoints[1], false)
+	_, err = mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+	assert(t, err != nil, "expected reads to be refused before the schema is read")
+
+	// The replica is enough to read it, and to serve from
+	waitForSchema(mysql)
+	equals(t, "domains", mysql.Schema())
+	_, err = mysql.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "A")
+	ok(t, err)
+	assert(t, strings.Contains(fakeDB.lastQuery(endpoints[1]), "domains"),
+		"unexpected query: %s", fakeDB.lastQuery(endpoints[1]))
+	equals(t, 0, fakeDB.queried(endpoints[0]))
+}
+
+func TestFailoverShardsCheckedLate(t *testing.T) {
+	SetUp()
+	mdns.Conf.Shards = &mdns.ShardRange{Min: 0, Max: 2047}
+	mysql, endpoints, err := openDown("shardslate", 75)
+	defer mysql.Close()
+	assert(t, err != nil, "expected Open to fail with every endpoint down")
+
+	equals(t, 0, len(mysql.Failed()))
+
+	// Found once the database answers, and reported so mdns stops, as it
+	// would have at startup
+	fakeDB.setDown(endpoints[0], false)
+	err = nil
+	select {
+	case err = <-mysql.Failed():
+	case <-time.After(2 * time.Second):
+	}
+	assert(t, err != nil && strings.Contains(err.Error(), "-shards"), "expected a -shards error, got %v", err)
+	equals(t, "", mysql.Schema())
+}
+
+func TestFailoverIgnoresMissingRows(t *testing.T) {
+	mysql, _, _ := openFake(t, "norows")
+	defer mysql.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err := mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "missing.com.")
+		equals(t, sql.ErrNoRows, err)
+	}
+	equals(t, map[string]bool{"primary": true, "replica0": true, "replica1": true}, healthy(mysql))
+}
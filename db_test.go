@@ -3,7 +3,10 @@ package mdns_test
 import (
 	"database/sql"
 	"fmt"
+	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
 	"testing"
 
 	"github.com/rackerlabs/mdns"
@@ -33,7 +36,7 @@ func TestDBGetAxfr(t *testing.T) {
 
 	storage := mdns.Storage{Driver: mysql}
 
-	rrs, err := storage.Driver.GetFullAxfrRRs("gomdns.com.")
+	rrs, err := storage.Driver.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
 	assert(t, err == nil, fmt.Sprintf("There was an error getting axfr rrs: %s", err))
 	assert(t, len(rrs) == 3, fmt.Sprintf("Wrong number of records: %d", len(rrs)))
 }
@@ -41,14 +44,16 @@ func TestDBGetAxfr(t *testing.T) {
 func TestDBGetAxfrBadDB(t *testing.T) {
 	SetUp()
 
-	// Connect to the right database
+	// Connect to a database without Designate's schema, which is caught
+	// when the schema version is read
 	mdns.Conf.DbConn = "root:password@tcp(127.0.0.1:3306)/mysql"
 	mysql := &mdns.MySQLDriver{}
-	ok(t, mysql.Open())
+	err := mysql.Open()
+	assert(t, err != nil, "There should have been an error")
 
 	storage := mdns.Storage{Driver: mysql}
 
-	_, err := storage.Driver.GetFullAxfrRRs("gomdns.com.")
+	_, err = storage.Driver.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
 	assert(t, err != nil, "There should have been an error")
 }
 
@@ -60,7 +65,7 @@ func TestDBSOAQuery(t *testing.T) {
 
 	storage := mdns.Storage{Driver: mysql}
 
-	rrs, err := storage.Driver.GetQueryRRs("gomdns.com.", "SOA")
+	rrs, err := storage.Driver.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
 	assert(t, err == nil, fmt.Sprintf("There was an error getting axfr rrs: %s", err))
 	assert(t, len(rrs) == 1, fmt.Sprintf("Wrong number of records: %d", len(rrs)))
 	serial := rrs[0].(*dns.SOA).Serial
@@ -78,7 +83,7 @@ func TestDBSOAQueryBadDB(t *testing.T) {
 
 	storage := mdns.Storage{Driver: mysql}
 
-	_, err := storage.Driver.GetQueryRRs("gomdns.com.", "SOA")
+	_, err := storage.Driver.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
 	assert(t, err != nil, "There should have been an error")
 }
 
@@ -104,3 +109,149 @@ func TestBuildDNSRRsNoRRs(t *testing.T) {
 	assert(t, dnsRRs == nil, fmt.Sprintf("DnsRRs wasn't []: %v", dnsRRs))
 	assert(t, err != nil, "There was no error!")
 }
+
+// badRecordCount is how many records of rrtype have been reported as bad
+func badRecordCount(tb testing.TB, rrtype string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	ok(tb, err)
+	for _, family := range families {
+		if family.GetName() != "mdns_bad_records_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == rrtype {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestBuildDNSRRsBadRecord(t *testing.T) {
+	SetUp()
+
+	zone := mdns.Zone{Name: "foo.com.", Ttl: 300}
+	ttl := sql.NullInt64{Int64: 300, Valid: true}
+	rrs := []mdns.RR{
+		mdns.RR{Id: "soa", Rrtype: "SOA", Ttl: ttl, Name: "foo.com.", Data: "ns1.foo.com. hostmaster.foo.com. 1 3600 600 86400 300"},
+		mdns.RR{Id: "bad-address", Rrtype: "A", Ttl: ttl, Name: "bar.foo.com.", Data: "not-an-address"},
+		mdns.RR{Id: "comment", Rrtype: "A", Ttl: ttl, Name: "baz.foo.com.", Data: "192.0.2.1 ; 192.0.2.2"},
+		mdns.RR{Id: "directive", Rrtype: "TXT", Ttl: ttl, Name: "foo.com.", Data: "$INCLUDE /etc/passwd"},
+		mdns.RR{Id: "line-break", Rrtype: "TXT", Ttl: ttl, Name: "foo.com.", Data: "\"a\"\nfoo.com. 300 IN A 192.0.2.3"},
+		mdns.RR{Id: "dkim", Rrtype: "TXT", Ttl: ttl, Name: "foo.com.", Data: "\"v=DKIM1; k=rsa\""},
+		mdns.RR{Id: "good", Rrtype: "A", Ttl: ttl, Name: "bar.foo.com.", Data: "192.0.2.1"},
+	}
+
+	// The bad records are skipped, and the rest of the zone is served
+	badA, badTxt, badSoa := badRecordCount(t, "A"), badRecordCount(t, "TXT"), badRecordCount(t, "SOA")
+	dnsRRs, err := mdns.BuildDnsRRs(rrs, zone, true)
+	ok(t, err)
+	equals(t, 4, len(dnsRRs))
+	equals(t, []string{"v=DKIM1; k=rsa"}, dnsRRs[1].(*dns.TXT).Txt)
+	equals(t, "192.0.2.1", dnsRRs[2].(*dns.A).A.String())
+	equals(t, badA+2, badRecordCount(t, "A"))
+	equals(t, badTxt+2, badRecordCount(t, "TXT"))
+	equals(t, badSoa, badRecordCount(t, "SOA"))
+
+	// -strict_records fails the lot, as before
+	mdns.Conf.StrictRecords = true
+	defer func() { mdns.Conf.StrictRecords = false }()
+	_, err = mdns.BuildDnsRRs(rrs, zone, true)
+	assert(t, err != nil, "a bad record should fail the AXFR with -strict_records")
+}
+
+// dbQueryCount is how many database queries mdns has made so far
+func dbQueryCount(tb testing.TB) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	ok(tb, err)
+
+	count := uint64(0)
+	for _, family := range families {
+		if family.GetName() != "mdns_db_query_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			count += metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return count
+}
+
+func TestDBCoalescedAxfr(t *testing.T) {
+	SetUp()
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+
+	before := dbQueryCount(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "testbigdomain28580535.com.")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		ok(t, err)
+	}
+
+	// Each uncoalesced AXFR is 2 queries, the zone and its records
+	queries := dbQueryCount(t) - before
+	assert(t, queries < 40, fmt.Sprintf("Concurrent AXFRs should have shared queries, there were %d", queries))
+}
+
+// A secondary fleet AXFRing the same zone at once after a NOTIFY. db-queries/op
+// shows how many queries hit the database for each herd of 50 transfers.
+func BenchmarkThunderingHerdAxfr(b *testing.B) {
+	SetTestConfig()
+	log.SetLevel(log.ErrorLevel)
+
+	mysql := &mdns.MySQLDriver{}
+	ok(b, mysql.Open())
+
+	before := dbQueryCount(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "testbigdomain28580535.com.")
+			}()
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(dbQueryCount(b)-before)/float64(b.N), "db-queries/op")
+}
+
+func TestFindZone(t *testing.T) {
+	SetUp()
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+
+	for qname, zonename := range map[string]string{
+		"gomdns.com.":                         "gomdns.com.",
+		"WWW.gomdns.com.":                     "gomdns.com.",
+		"a.b.testbigdomain28580535.com.":      "testbigdomain28580535.com.",
+		"A27050359.testbigdomain28580535.com": "testbigdomain28580535.com.",
+	} {
+		zone, err := mysql.FindZone(mdns.NewRequestContext(), qname)
+		ok(t, err)
+		equals(t, zonename, zone.Name)
+	}
+
+	_, err := mysql.FindZone(mdns.NewRequestContext(), "gomdns.org.")
+	equals(t, sql.ErrNoRows, err)
+	// A zone's name is not a suffix of a longer label
+	_, err = mysql.FindZone(mdns.NewRequestContext(), "notgomdns.com.")
+	equals(t, sql.ErrNoRows, err)
+}
@@ -0,0 +1,281 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// dnstap
+//
+
+var (
+	dnstapFrames = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "dnstap_frames_total",
+		Help:      "dnstap frames handed to the dnstap output.",
+	})
+
+	dnstapDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "dnstap_dropped_total",
+		Help:      "dnstap frames dropped because the buffer was full, or still queued at shutdown.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(dnstapFrames, dnstapDropped)
+}
+
+// How long Close waits for queued frames to be written by default
+const tapCloseTimeout = 5 * time.Second
+
+// Tapper logs queries and responses as dnstap AUTH_QUERY/AUTH_RESPONSE frames.
+// Frames are queued on a bounded buffer and encoded in the background, so a
+// slow or missing reader drops frames instead of slowing down ServeDNS.
+type Tapper struct {
+	output   dnstap.Output
+	frames   chan tapFrame
+	identity []byte
+	version  []byte
+	dropped  uint64
+	mutex    sync.RWMutex
+	closed   bool
+	stop     chan struct{}
+	done     chan struct{}
+	timeout  time.Duration
+}
+
+// tapFrame is what ServeDNS hands over. Messages are packed later, in the
+// background, unless they were already written out as wire format.
+type tapFrame struct {
+	msgType dnstap.Message_Type
+	local   net.Addr
+	remote  net.Addr
+	msg     *dns.Msg
+	wire    []byte
+	query   time.Time
+	reply   time.Time
+}
+
+// OpenTapper creates a Tapper writing to a Frame Streams unix socket, or to a
+// file if socket is empty.
+func OpenTapper(socket, file string, bufferSize int) (*Tapper, error) {
+	var output dnstap.Output
+	var err error
+	switch {
+	case socket != "":
+		output, err = dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: socket, Net: "unix"})
+	case file != "":
+		output, err = dnstap.NewFrameStreamOutputFromFilename(file)
+	default:
+		err = errors.New("Either a dnstap socket or file is needed")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set up dnstap output: %s", err)
+	}
+	return NewTapper(output, bufferSize), nil
+}
+
+// NewTapper starts a Tapper writing frames to output.
+func NewTapper(output dnstap.Output, bufferSize int) *Tapper {
+	identity, _ := os.Hostname()
+	tap := &Tapper{
+		output:   output,
+		frames:   make(chan tapFrame, bufferSize),
+		identity: []byte(identity),
+		version:  []byte("mdns"),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		timeout:  tapCloseTimeout,
+	}
+	go output.RunOutputLoop()
+	go tap.run()
+	return tap
+}
+
+// Dropped returns how many frames have been dropped because the buffer was
+// full, or were still queued when Close gave up.
+func (tap *Tapper) Dropped() uint64 {
+	return atomic.LoadUint64(&tap.dropped)
+}
+
+// SetCloseTimeout sets how long Close waits for queued frames to be written.
+func (tap *Tapper) SetCloseTimeout(timeout time.Duration) {
+	tap.mutex.Lock()
+	defer tap.mutex.Unlock()
+	tap.timeout = timeout
+}
+
+// Close stops accepting frames and flushes the ones already queued. If the
+// output hasn't taken them within the close timeout, what's left is dropped.
+func (tap *Tapper) Close() {
+	tap.mutex.Lock()
+	if tap.closed {
+		tap.mutex.Unlock()
+		return
+	}
+	tap.closed = true
+	close(tap.frames)
+	timeout := tap.timeout
+	tap.mutex.Unlock()
+
+	select {
+	case <-tap.done:
+	case <-time.After(timeout):
+		close(tap.stop)
+		<-tap.done
+		dropped := uint64(0)
+		for range tap.frames {
+			dropped++
+		}
+		atomic.AddUint64(&tap.dropped, dropped)
+		dnstapDropped.Add(float64(dropped))
+		log.Warn(fmt.Sprintf("dnstap output still busy after %s, dropped %d queued frames", timeout, dropped))
+	}
+	tap.output.Close()
+}
+
+// TapQuery queues an AUTH_QUERY frame for request.
+func (tap *Tapper) TapQuery(writer dns.ResponseWriter, request *dns.Msg, received time.Time) {
+	tap.queue(tapFrame{
+		msgType: dnstap.Message_AUTH_QUERY,
+		local:   writer.LocalAddr(),
+		remote:  writer.RemoteAddr(),
+		msg:     request,
+		query:   received,
+	})
+}
+
+// TapResponse queues an AUTH_RESPONSE frame. Exactly one of response and wire
+// should be set.
+func (tap *Tapper) TapResponse(writer dns.ResponseWriter, response *dns.Msg, wire []byte, received time.Time) {
+	tap.queue(tapFrame{
+		msgType: dnstap.Message_AUTH_RESPONSE,
+		local:   writer.LocalAddr(),
+		remote:  writer.RemoteAddr(),
+		msg:     response,
+		wire:    wire,
+		query:   received,
+		reply:   time.Now(),
+	})
+}
+
+func (tap *Tapper) queue(frame tapFrame) {
+	tap.mutex.RLock()
+	defer tap.mutex.RUnlock()
+	if tap.closed {
+		return
+	}
+
+	select {
+	case tap.frames <- frame:
+	default:
+		atomic.AddUint64(&tap.dropped, 1)
+		dnstapDropped.Inc()
+	}
+}
+
+func (tap *Tapper) run() {
+	defer close(tap.done)
+	for frame := range tap.frames {
+		buf, err := tap.encode(frame)
+		if err != nil {
+			log.Debug(fmt.Sprintf("Error encoding dnstap frame: %s", err))
+			continue
+		}
+		select {
+		case tap.output.GetOutputChannel() <- buf:
+			dnstapFrames.Inc()
+		case <-tap.stop:
+			// The frame being written is lost too
+			atomic.AddUint64(&tap.dropped, 1)
+			dnstapDropped.Inc()
+			return
+		}
+	}
+}
+
+func (tap *Tapper) encode(frame tapFrame) ([]byte, error) {
+	wire := frame.wire
+	if wire == nil {
+		var err error
+		wire, err = frame.msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	message := &dnstap.Message{Type: &frame.msgType}
+	setTapAddrs(message, frame.local, frame.remote)
+
+	querySec, queryNsec := uint64(frame.query.Unix()), uint32(frame.query.Nanosecond())
+	message.QueryTimeSec = &querySec
+	message.QueryTimeNsec = &queryNsec
+	if frame.msgType == dnstap.Message_AUTH_QUERY {
+		message.QueryMessage = wire
+	} else {
+		replySec, replyNsec := uint64(frame.reply.Unix()), uint32(frame.reply.Nanosecond())
+		message.ResponseTimeSec = &replySec
+		message.ResponseTimeNsec = &replyNsec
+		message.ResponseMessage = wire
+	}
+
+	dtType := dnstap.Dnstap_MESSAGE
+	return proto.Marshal(&dnstap.Dnstap{
+		Identity: tap.identity,
+		Version:  tap.version,
+		Type:     &dtType,
+		Message:  message,
+	})
+}
+
+// setTapAddrs fills in the socket details. The query address is the client,
+// the response address is mdns.
+func setTapAddrs(message *dnstap.Message, local, remote net.Addr) {
+	var protocol dnstap.SocketProtocol
+	var localIP, remoteIP net.IP
+	var localPort, remotePort int
+
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		protocol = dnstap.SocketProtocol_UDP
+		remoteIP, remotePort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		protocol = dnstap.SocketProtocol_TCP
+		remoteIP, remotePort = addr.IP, addr.Port
+	default:
+		return
+	}
+	switch addr := local.(type) {
+	case *net.UDPAddr:
+		localIP, localPort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		localIP, localPort = addr.IP, addr.Port
+	}
+
+	family := dnstap.SocketFamily_INET6
+	if ip4 := remoteIP.To4(); ip4 != nil {
+		family = dnstap.SocketFamily_INET
+		remoteIP = ip4
+		localIP = localIP.To4()
+	}
+	queryPort, responsePort := uint32(remotePort), uint32(localPort)
+
+	message.SocketFamily = &family
+	message.SocketProtocol = &protocol
+	message.QueryAddress = remoteIP
+	message.QueryPort = &queryPort
+	message.ResponseAddress = localIP
+	message.ResponsePort = &responsePort
+}
@@ -0,0 +1,112 @@
+package mdns_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/rackerlabs/mdns"
+)
+
+// A dnstap.Output that nobody reads from
+type stuckOutput struct {
+	ch     chan []byte
+	closed bool
+}
+
+func (output *stuckOutput) GetOutputChannel() chan []byte { return output.ch }
+
+func (output *stuckOutput) RunOutputLoop() {}
+
+func (output *stuckOutput) Close() { output.closed = true }
+
+type udpResponseWriter struct {
+	FakeResponseWriter
+}
+
+func (writer *udpResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5354}
+}
+
+func (writer *udpResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 40000}
+}
+
+func TestTapperFile(t *testing.T) {
+	SetUp()
+
+	dir, err := ioutil.TempDir("", "mdns-dnstap")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dnstap.fstrm")
+
+	tap, err := mdns.OpenTapper("", file, 10)
+	ok(t, err)
+
+	writer := &udpResponseWriter{}
+	request := generateMsg("gomdns.com.", dns.TypeSOA, dns.OpcodeQuery)
+	tap.TapQuery(writer, &request, time.Now())
+	tap.TapResponse(writer, mdns.PrepReply(&request), nil, time.Now())
+	tap.Close()
+
+	input, err := dnstap.NewFrameStreamInputFromFilename(file)
+	ok(t, err)
+	frames := make(chan []byte, 10)
+	input.ReadInto(frames)
+	close(frames)
+
+	types := []dnstap.Message_Type{}
+	for frame := range frames {
+		dt := &dnstap.Dnstap{}
+		ok(t, proto.Unmarshal(frame, dt))
+		types = append(types, dt.Message.GetType())
+		equals(t, uint32(40000), dt.Message.GetQueryPort())
+		equals(t, dnstap.SocketProtocol_UDP, dt.Message.GetSocketProtocol())
+	}
+	equals(t, []dnstap.Message_Type{dnstap.Message_AUTH_QUERY, dnstap.Message_AUTH_RESPONSE}, types)
+}
+
+func TestTapperDropsWhenFull(t *testing.T) {
+	SetUp()
+
+	tap := mdns.NewTapper(&stuckOutput{ch: make(chan []byte)}, 1)
+
+	writer := &udpResponseWriter{}
+	request := generateMsg("gomdns.com.", dns.TypeSOA, dns.OpcodeQuery)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		tap.TapQuery(writer, &request, time.Now())
+	}
+
+	assert(t, time.Since(start) < time.Second, "Tapping should never block")
+	assert(t, tap.Dropped() >= 98, fmt.Sprintf("At least 98 frames should have been dropped, got %d", tap.Dropped()))
+}
+
+func TestTapperCloseTimeout(t *testing.T) {
+	SetUp()
+
+	output := &stuckOutput{ch: make(chan []byte)}
+	tap := mdns.NewTapper(output, 10)
+	tap.SetCloseTimeout(50 * time.Millisecond)
+
+	writer := &udpResponseWriter{}
+	request := generateMsg("gomdns.com.", dns.TypeSOA, dns.OpcodeQuery)
+	for i := 0; i < 5; i++ {
+		tap.TapQuery(writer, &request, time.Now())
+	}
+
+	// Nothing reads the output, so Close gives up and drops the queue
+	start := time.Now()
+	tap.Close()
+	assert(t, time.Since(start) < time.Second, "Close should not wait past its timeout")
+	assert(t, output.closed, "The output should be closed")
+	equals(t, uint64(5), tap.Dropped())
+}
@@ -0,0 +1,216 @@
+package mdns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//
+// Zone Export
+//
+
+// WriteZoneFile writes rrs, a zone in AXFR order, as an RFC 1035 zone file.
+// The $TTL is the SOA's, and every record carries its own TTL as well.
+func WriteZoneFile(w io.Writer, zonename string, rrs []dns.RR) error {
+	if len(rrs) == 0 {
+		return errors.New("No records to export")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return errors.New("Zone does not start with an SOA record")
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "; %s serial %d, exported by mdns\n", zonename, soa.Serial)
+	fmt.Fprintf(out, "$ORIGIN %s\n", dns.Fqdn(zonename))
+	fmt.Fprintf(out, "$TTL %d\n", soa.Hdr.Ttl)
+	// The SOA is on both ends of an AXFR, skip the last one
+	for _, rr := range rrs[:len(rrs)-1] {
+		fmt.Fprintln(out, rr.String())
+	}
+	return out.Flush()
+}
+
+// ZoneFileName is the name a zone is exported to, e.g. example.com.zone.
+func ZoneFileName(zonename string) string {
+	return strings.TrimSuffix(strings.ToLower(dns.Fqdn(zonename)), ".") + ".zone"
+}
+
+// ExportZone writes the zone driver would transfer for zonename to a file in
+// dir, returning the file's path. The file is replaced in one go, so a
+// reader never sees half a zone.
+func ExportZone(ctx context.Context, driver Driver, zonename string, dir string) (string, error) {
+	rrs, err := driver.GetFullAxfrRRs(ctx, zonename)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, ZoneFileName(zonename))
+	tmp, err := ioutil.TempFile(dir, ZoneFileName(zonename)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = WriteZoneFile(tmp, zonename, rrs)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// ZoneNames returns the name of every zone driver serves, in order.
+func ZoneNames(ctx context.Context, driver Driver) ([]string, error) {
+	serials, err := driver.GetZoneSerials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range serials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ExportTask is a pending zone_tasks row of type EXPORT.
+type ExportTask struct {
+	Id       string
+	ZoneName string `db:"name"`
+}
+
+// GetExportTasks returns the pending EXPORT tasks for zones in the pool,
+// oldest first.
+func (mysql *MySQLDriver) GetExportTasks(ctx context.Context) ([]ExportTask, error) {
+	names := mysql.names()
+	if names.TaskTable == "" {
+		return nil, fmt.Errorf("export tasks are not supported with the %s schema", names.Name)
+	}
+	filter, args := shardFilter()
+	query := fmt.Sprintf(
+		`SELECT tasks.id, zones.name
+		       FROM %s AS tasks
+		       INNER JOIN %s AS zones ON zones.id = tasks.%s
+		       WHERE tasks.task_type = 'EXPORT'
+		       AND tasks.status = 'PENDING'
+		       AND zones.pool_id = '794ccc2cd75144feb57f8894c9f5c842'
+		       AND zones.deleted = '0'%s
+		       ORDER BY tasks.created_at`,
+		names.TaskTable, names.ZoneTable, names.ZoneIdColumn, filter)
+
+	var tasks []ExportTask
+	err := mysql.read(ctx, func(db *sqlx.DB) error {
+		tasks = nil
+		start := time.Now()
+		err := db.SelectContext(ctx, &tasks, query, args...)
+		observeDBQuery("export_tasks", start, err)
+		return err
+	})
+	if err != nil {
+		LoggerFrom(ctx).Error(fmt.Sprintf("Error fetching export tasks: %s", err))
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// zone_tasks.location and zone_tasks.message are varchar(160)
+const taskColumnLength = 160
+
+// FinishExportTask records the outcome of an export task. Only a task that
+// is still PENDING is updated, and false is returned if it wasn't. A message
+// that doesn't fit is cut short, but a location that doesn't fit is an error,
+// since it would point somewhere else.
+func (mysql *MySQLDriver) FinishExportTask(ctx context.Context, id string, status string, location string, message string) (bool, error) {
+	if utf8.RuneCountInString(location) > taskColumnLength {
+		return false, fmt.Errorf("location is longer than %d characters", taskColumnLength)
+	}
+	if utf8.RuneCountInString(message) > taskColumnLength {
+		message = string([]rune(message)[:taskColumnLength])
+	}
+	var updated int64
+	err := mysql.write(ctx, func(db *sqlx.DB) error {
+		start := time.Now()
+		result, err := db.ExecContext(ctx, fmt.Sprintf(
+			`UPDATE %s
+			       SET status = ?, location = ?, message = ?,
+			           version = version + 1, updated_at = UTC_TIMESTAMP()
+			       WHERE id = ?
+			       AND status = 'PENDING'`, mysql.names().TaskTable),
+			status, location, message, id)
+		observeDBQuery("finish_export_task", start, err)
+		if err != nil {
+			return err
+		}
+		updated, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		LoggerFrom(ctx).Error(fmt.Sprintf("Error updating export task %s: %s", id, err))
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// ProcessExportTasks exports the zone of every pending EXPORT task to dir,
+// from driver, and marks each task COMPLETE with the file's location, or
+// ERROR with what went wrong. A task that can't be marked COMPLETE is marked
+// ERROR instead, and the rest are still processed. It returns how many tasks
+// completed, and the last error updating a task.
+func ProcessExportTasks(ctx context.Context, mysql *MySQLDriver, driver Driver, dir string) (int, error) {
+	logger := LoggerFrom(ctx)
+	tasks, err := mysql.GetExportTasks(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	completed := 0
+	var updateErr error
+	for _, task := range tasks {
+		status, location, message := "COMPLETE", "", ""
+		path, err := ExportZone(ctx, driver, task.ZoneName, dir)
+		if err == nil {
+			path, err = filepath.Abs(path)
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("Export task %s for %s failed: %s", task.Id, task.ZoneName, err))
+			status, message = "ERROR", err.Error()
+		} else {
+			location = "file://" + path
+		}
+
+		updated, err := mysql.FinishExportTask(ctx, task.Id, status, location, message)
+		if err != nil && status == "COMPLETE" {
+			logger.Error(fmt.Sprintf("Couldn't mark export task %s COMPLETE: %s", task.Id, err))
+			status = "ERROR"
+			updated, err = mysql.FinishExportTask(ctx, task.Id, status, "", err.Error())
+		}
+		if err != nil {
+			updateErr = err
+			continue
+		}
+		if !updated {
+			logger.Warn(fmt.Sprintf("Export task %s was no longer pending", task.Id))
+			continue
+		}
+		if status == "COMPLETE" {
+			completed++
+			logger.Info(fmt.Sprintf("Export task %s wrote %s to %s", task.Id, task.ZoneName, path))
+		}
+	}
+	return completed, updateErr
+}
@@ -0,0 +1,184 @@
+package mdns_test
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/miekg/dns"
+	"github.com/rackerlabs/mdns"
+)
+
+func readZoneFile(t *testing.T, zonename string, text string) []dns.RR {
+	parser := dns.NewZoneParser(strings.NewReader(text), zonename, "")
+	rrs := []dns.RR{}
+	for rr, more := parser.Next(); more; rr, more = parser.Next() {
+		rrs = append(rrs, rr)
+	}
+	ok(t, parser.Err())
+	return rrs
+}
+
+func TestExportZoneFile(t *testing.T) {
+	rrs := []dns.RR{}
+	for _, record := range []string{
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300",
+	} {
+		rr, err := dns.NewRR(record)
+		ok(t, err)
+		rrs = append(rrs, rr)
+	}
+
+	buf := &bytes.Buffer{}
+	ok(t, mdns.WriteZoneFile(buf, "example.com.", rrs))
+	lines := strings.Split(buf.String(), "\n")
+	equals(t, "$ORIGIN example.com.", lines[1])
+	equals(t, "$TTL 3600", lines[2])
+
+	parsed := readZoneFile(t, "example.com.", buf.String())
+	equals(t, 3, len(parsed))
+	for i, rr := range parsed {
+		assert(t, dns.IsDuplicate(rrs[i], rr), "record %d is %s, expected %s", i, rr, rrs[i])
+	}
+	equals(t, "example.com.zone", mdns.ZoneFileName("Example.COM."))
+}
+
+func TestExportZone(t *testing.T) {
+	SetUp()
+	dir, err := ioutil.TempDir("", "mdns-export")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	path, err := mdns.ExportZone(mdns.NewRequestContext(), mysql, "gomdns.com.", dir)
+	ok(t, err)
+	equals(t, filepath.Join(dir, "gomdns.com.zone"), path)
+
+	text, err := ioutil.ReadFile(path)
+	ok(t, err)
+	axfr, err := mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	equals(t, len(axfr)-1, len(readZoneFile(t, "gomdns.com.", string(text))))
+}
+
+func TestExportTasks(t *testing.T) {
+	SetUp()
+	dir, err := ioutil.TempDir("", "mdns-export")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := sqlx.Open(mdns.Conf.DbType, mdns.Conf.DbConn)
+	ok(t, err)
+	defer db.Close()
+	id := "0000000000000000000000mdnsexport"
+	_, err = db.Exec(`INSERT INTO zone_tasks (id, created_at, version, zone_id, task_type, status)
+	       VALUES (?, UTC_TIMESTAMP(), 1, '0f0d4e20c8f647d2982310f27332cdea', 'EXPORT', 'PENDING')`, id)
+	ok(t, err)
+	defer db.Exec(`DELETE FROM zone_tasks WHERE id = ?`, id)
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	completed, err := mdns.ProcessExportTasks(mdns.NewRequestContext(), mysql, mysql, dir)
+	ok(t, err)
+	equals(t, 1, completed)
+
+	var status, location string
+	ok(t, db.QueryRow(`SELECT status, location FROM zone_tasks WHERE id = ?`, id).Scan(&status, &location))
+	equals(t, "COMPLETE", status)
+	equals(t, "file://"+filepath.Join(dir, "gomdns.com.zone"), location)
+}
+
+// cannedExportTasks makes the fake database list an EXPORT task for each
+// zone, with ids task0, task1...
+func cannedExportTasks(zones ...string) {
+	tasks := [][]driver.Value{}
+	for i, zone := range zones {
+		tasks = append(tasks, []driver.Value{fmt.Sprintf("task%d", i), zone})
+	}
+	fakeDB.setRows("task_type = 'EXPORT'", []string{"id", "name"}, tasks...)
+}
+
+// finishedTasks returns the status and location each task was given, from
+// the UPDATEs run on the fake database.
+func finishedTasks() map[string][]string {
+	finished := map[string][]string{}
+	for _, args := range fakeDB.executed() {
+		finished[args[3].(string)] = []string{args[0].(string), args[1].(string)}
+	}
+	return finished
+}
+
+func TestExportTasksCarryOn(t *testing.T) {
+	mysql, _, _ := openFake(t, "export")
+	defer mysql.Close()
+	dir, err := ioutil.TempDir("", "mdns-export")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cannedExportTasks("gomdns.com.", "missing.com.", "gomdns.com.")
+	defer fakeDB.clearRows()
+	fakeDB.failExec("COMPLETE", "task0")
+
+	completed, err := mdns.ProcessExportTasks(mdns.NewRequestContext(), mysql, openGomdns(t), dir)
+	assert(t, err == nil, "only the COMPLETE update failed, and the ERROR one worked: %v", err)
+	equals(t, 1, completed)
+	location := "file://" + filepath.Join(dir, "gomdns.com.zone")
+	equals(t, map[string][]string{
+		"task0": {"ERROR", ""},
+		"task1": {"ERROR", ""},
+		"task2": {"COMPLETE", location},
+	}, finishedTasks())
+
+	// With no way to record the outcome, the error is returned once every
+	// task has been tried
+	fakeDB.clearRows()
+	cannedExportTasks("gomdns.com.", "gomdns.com.")
+	fakeDB.failExec("task0")
+	completed, err = mdns.ProcessExportTasks(mdns.NewRequestContext(), mysql, openGomdns(t), dir)
+	assert(t, err != nil, "expected the failed update to be returned")
+	equals(t, 1, completed)
+	equals(t, map[string][]string{"task1": {"COMPLETE", location}}, finishedTasks())
+}
+
+func TestExportTasksLongLocation(t *testing.T) {
+	mysql, _, _ := openFake(t, "export-long")
+	defer mysql.Close()
+	tmp, err := ioutil.TempDir("", "mdns-export")
+	ok(t, err)
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, strings.Repeat("d", 160))
+	ok(t, os.Mkdir(dir, 0700))
+
+	cannedExportTasks("gomdns.com.")
+	defer fakeDB.clearRows()
+	completed, err := mdns.ProcessExportTasks(mdns.NewRequestContext(), mysql, openGomdns(t), dir)
+	ok(t, err)
+	equals(t, 0, completed)
+	equals(t, 1, len(fakeDB.executed()))
+	args := fakeDB.executed()[0]
+	equals(t, "ERROR", args[0])
+	equals(t, "", args[1])
+	assert(t, strings.Contains(args[2].(string), "160"), "unexpected message: %s", args[2])
+}
+
+func TestFinishExportTaskMessage(t *testing.T) {
+	mysql, _, _ := openFake(t, "export-message")
+	defer mysql.Close()
+	defer fakeDB.clearRows()
+
+	updated, err := mysql.FinishExportTask(mdns.NewRequestContext(), "task0", "ERROR", "", strings.Repeat("é", 200))
+	ok(t, err)
+	assert(t, updated, "the task should have been updated")
+	message := fakeDB.executed()[0][2].(string)
+	equals(t, strings.Repeat("é", 160), message)
+}
@@ -0,0 +1,93 @@
+package mdns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+//
+// Health
+//
+
+// HealthChecker answers the /healthz and /readyz endpoints.
+type HealthChecker struct {
+	Storage    Storage
+	Listeners  *Listeners
+	CanaryZone string
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+func checkResult(err error) CheckResult {
+	if err != nil {
+		return CheckResult{Status: "fail", Error: err.Error()}
+	}
+	return CheckResult{Status: "ok"}
+}
+
+// Ready runs every readiness check. The report is "ok" only if all of them are.
+func (health *HealthChecker) Ready() HealthReport {
+	report := HealthReport{Status: "ok", Checks: map[string]CheckResult{}}
+
+	ctx, cancel := withTimeout(context.Background(), Conf.QueryTimeout)
+	defer cancel()
+	report.Checks["database"] = checkResult(health.Storage.Driver.Ping(ctx))
+
+	var err error
+	if health.Listeners == nil || !health.Listeners.Bound() {
+		err = errors.New("dns listeners are not bound")
+	}
+	report.Checks["listeners"] = checkResult(err)
+
+	if health.CanaryZone != "" {
+		report.Checks["canary"] = checkResult(health.checkCanary(ctx))
+	}
+
+	for name, check := range report.Checks {
+		if check.Status != "ok" {
+			log.Warn(fmt.Sprintf("Readiness check %s failed: %s", name, check.Error))
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+func (health *HealthChecker) checkCanary(ctx context.Context) error {
+	ctx = WithLogger(ctx, NewRequestLog().WithField("check", "canary"))
+	rrs, err := health.Storage.Driver.GetQueryRRs(ctx, health.CanaryZone, "SOA")
+	if err != nil {
+		return err
+	}
+	if len(rrs) == 0 {
+		return fmt.Errorf("no SOA found for %s", health.CanaryZone)
+	}
+	return nil
+}
+
+func (health *HealthChecker) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, HealthReport{Status: "ok"})
+}
+
+func (health *HealthChecker) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, health.Ready())
+}
+
+func writeReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,39 @@
+package mdns
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+)
+
+//
+// HTTP
+//
+
+// StartHTTP binds addr and serves the HTTP endpoints (/metrics, /healthz and
+// /readyz) on it. Like Serve, a bind failure is returned rather than
+// happening in the background.
+func StartHTTP(addr string, health *HealthChecker) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.serveHealthz)
+	mux.HandleFunc("/readyz", health.serveReadyz)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set up the http listener on %s: %s", addr, err)
+	}
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	log.Info(fmt.Sprintf("starting mdns http listener on %s", addr))
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error(fmt.Sprintf("The http listener on %s failed: %s", addr, err))
+		}
+	}()
+
+	return server, nil
+}
@@ -0,0 +1,99 @@
+package mdns_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/rackerlabs/mdns"
+)
+
+func getHTTP(tb testing.TB, url string) (int, string) {
+	resp, err := http.Get(url)
+	ok(tb, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	ok(tb, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestStartHTTPMetrics(t *testing.T) {
+	SetUp()
+
+	server, err := mdns.StartHTTP("127.0.0.1:59153", &mdns.HealthChecker{})
+	ok(t, err)
+	defer server.Close()
+
+	status, body := getHTTP(t, "http://127.0.0.1:59153/metrics")
+	assert(t, status == http.StatusOK, fmt.Sprintf("Status should be 200, it was: %d", status))
+	assert(t, strings.Contains(body, "mdns_axfr_in_flight"), "mdns_axfr_in_flight is missing from /metrics")
+}
+
+func TestStartHTTPBindError(t *testing.T) {
+	SetUp()
+
+	server, err := mdns.StartHTTP("127.0.0.1:59154", &mdns.HealthChecker{})
+	ok(t, err)
+	defer server.Close()
+
+	_, err = mdns.StartHTTP("127.0.0.1:59154", &mdns.HealthChecker{})
+	assert(t, err != nil, "There should have been an error binding 59154 twice")
+}
+
+func TestHealthz(t *testing.T) {
+	SetUp()
+
+	server, err := mdns.StartHTTP("127.0.0.1:59155", &mdns.HealthChecker{})
+	ok(t, err)
+	defer server.Close()
+
+	status, _ := getHTTP(t, "http://127.0.0.1:59155/healthz")
+	assert(t, status == http.StatusOK, fmt.Sprintf("Status should be 200, it was: %d", status))
+}
+
+func TestReadyzNotReady(t *testing.T) {
+	SetUp()
+
+	// The driver was never opened, and there are no listeners
+	storage := mdns.Storage{Driver: &mdns.MySQLDriver{}}
+	health := &mdns.HealthChecker{Storage: storage}
+	server, err := mdns.StartHTTP("127.0.0.1:59156", health)
+	ok(t, err)
+	defer server.Close()
+
+	status, body := getHTTP(t, "http://127.0.0.1:59156/readyz")
+	assert(t, status == http.StatusServiceUnavailable, fmt.Sprintf("Status should be 503, it was: %d", status))
+
+	report := mdns.HealthReport{}
+	ok(t, json.Unmarshal([]byte(body), &report))
+	equals(t, "fail", report.Status)
+	equals(t, "fail", report.Checks["database"].Status)
+	equals(t, "fail", report.Checks["listeners"].Status)
+	_, found := report.Checks["canary"]
+	assert(t, !found, "The canary check should be skipped without a canary zone")
+}
+
+func TestReadyz(t *testing.T) {
+	SetUp()
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	storage := mdns.Storage{Driver: mysql}
+
+	addrs := []mdns.ListenAddr{mdns.ListenAddr{Net: "udp", Host: "127.0.0.1", Port: "55556"}}
+	listeners, err := mdns.Serve(addrs, mdns.NewDefaultMdnsHandler(storage))
+	ok(t, err)
+	defer listeners.Shutdown()
+
+	health := &mdns.HealthChecker{Storage: storage, Listeners: listeners, CanaryZone: "gomdns.com."}
+	report := health.Ready()
+	equals(t, "ok", report.Status)
+	equals(t, "ok", report.Checks["canary"].Status)
+
+	health.CanaryZone = "notarealzone.com."
+	report = health.Ready()
+	equals(t, "fail", report.Status)
+}
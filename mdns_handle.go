@@ -1,11 +1,15 @@
 package mdns
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
+	"net"
 	"strings"
+	"time"
 )
 
 //
@@ -13,33 +17,69 @@ import (
 //
 
 type MdnsHandler struct {
-	storage   Storage
-	axfrFunc  func(dns.ResponseWriter, *dns.Msg, Storage) error
-	queryFunc func(dns.Question, *dns.Msg, Storage) (*dns.Msg, error)
-	errorFunc func(*dns.Msg, string) *dns.Msg
+	storage    Storage
+	axfrFunc   func(context.Context, dns.ResponseWriter, *dns.Msg, Storage) error
+	queryFunc  func(context.Context, dns.Question, *dns.Msg, Storage) (*dns.Msg, error)
+	notifyFunc func(context.Context, dns.ResponseWriter, *dns.Msg, Storage) (*dns.Msg, error)
+	errorFunc  func(*dns.Msg, string) *dns.Msg
+	tap        *Tapper
 }
 
 func NewDefaultMdnsHandler(storage Storage) MdnsHandler {
 	return MdnsHandler{
-		axfrFunc:  handleAXFR,
-		queryFunc: handleQuery,
-		errorFunc: handleError,
-		storage:   storage,
+		axfrFunc:   handleAXFR,
+		queryFunc:  handleQuery,
+		notifyFunc: handleNotify,
+		errorFunc:  handleError,
+		storage:    storage,
 	}
 }
 
-func (mdns *MdnsHandler) ServeDNS(writer dns.ResponseWriter, request *dns.Msg) {
+// SetTapper sends every query and response handled to tap.
+func (mdns *MdnsHandler) SetTapper(tap *Tapper) {
+	mdns.tap = tap
+}
+
+func (mdns *MdnsHandler) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
 	log.Debug(debugRequest(*request, request.Question[0]))
 
+	start := time.Now()
+	writer := &responseRecorder{ResponseWriter: w, tap: mdns.tap, received: start}
+	if mdns.tap != nil {
+		mdns.tap.TapQuery(w, request, start)
+	}
+	logger := requestLog(writer, request)
+	defer logRequest(logger, writer, start)
+	defer observeRequest(writer, request.Question[0], start)
+
+	// Storage calls give up once the deadline passes, rather than holding
+	// this goroutine for as long as the database takes.
+	timeout := Conf.QueryTimeout
+	if request.Question[0].Qtype == dns.TypeAXFR {
+		timeout = Conf.AxfrTimeout
+	}
+	ctx, cancel := withTimeout(WithLogger(context.Background(), logger), timeout)
+	defer cancel()
+
 	var message *dns.Msg
 	var err error
 
 	switch request.Opcode {
 	case dns.OpcodeQuery:
 		if request.Question[0].Qtype == dns.TypeAXFR {
-			err = mdns.axfrFunc(writer, request, mdns.storage)
-			if err != nil {
-				log.Error(fmt.Sprintf("Problem with AXFR for %s: %s", request.Question[0].Name, err))
+			axfrInFlight.Inc()
+			err = mdns.axfrFunc(ctx, writer, request, mdns.storage)
+			axfrInFlight.Dec()
+			if err != nil && writer.written {
+				// Part of the transfer has gone out, and an error message
+				// now would be read as more of it.
+				logger.Error(fmt.Sprintf("AXFR for %s failed part way, closing the connection: %s", request.Question[0].Name, err))
+				w.Close()
+				return
+			} else if err == ErrZoneRefused {
+				message = mdns.errorFunc(request, "REFUSED")
+			} else if err != nil {
+				logger.Error(fmt.Sprintf("Problem with AXFR for %s: %s", request.Question[0].Name, err))
 				message = mdns.errorFunc(request, "SERVFAIL")
 			} else {
 				return
@@ -48,20 +88,45 @@ func (mdns *MdnsHandler) ServeDNS(writer dns.ResponseWriter, request *dns.Msg) {
 			message = mdns.errorFunc(request, "REFUSED")
 		} else {
 			message = PrepReply(request)
-			message, err = mdns.queryFunc(request.Question[0], message, mdns.storage)
+			message, err = mdns.queryFunc(ctx, request.Question[0], message, mdns.storage)
 			if err != nil {
 				message = mdns.errorFunc(request, err.Error())
 			}
 		}
 
+	case dns.OpcodeNotify:
+		message, err = mdns.notifyFunc(ctx, writer, request, mdns.storage)
+		if err != nil {
+			message = mdns.errorFunc(request, err.Error())
+		}
+
 	default:
-		log.Info(fmt.Sprintf("ERROR %s : unsupported opcode %d", request.Question[0].Name, request.Opcode))
+		logger.Info(fmt.Sprintf("ERROR %s : unsupported opcode %d", request.Question[0].Name, request.Opcode))
 		message = mdns.errorFunc(request, "REFUSED")
 	}
 
+	if message.Rcode == dns.RcodeServerFailure && ctx.Err() == context.DeadlineExceeded {
+		logger.Warn(fmt.Sprintf("Gave up on %s after %s", request.Question[0].Name, timeout))
+		addTimeoutError(request, message)
+	}
 	writer.WriteMsg(message)
 }
 
+// addTimeoutError explains a SERVFAIL caused by the request deadline with an
+// Extended DNS Error (RFC 8914), if the client sent EDNS.
+func addTimeoutError(request *dns.Msg, message *dns.Msg) {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return
+	}
+	message.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	reply := message.IsEdns0()
+	reply.Option = append(reply.Option, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeOther,
+		ExtraText: "timed out waiting for the database",
+	})
+}
+
 func PrepReply(request *dns.Msg) *dns.Msg {
 	question := request.Question[0]
 
@@ -87,6 +152,8 @@ func handleError(message *dns.Msg, op string) *dns.Msg {
 		message.SetRcode(message, dns.RcodeRefused)
 	case "SERVFAIL":
 		message.SetRcode(message, dns.RcodeServerFailure)
+	case "NOTAUTH":
+		message.SetRcode(message, dns.RcodeNotAuth)
 	default:
 		message.SetRcode(message, dns.RcodeServerFailure)
 	}
@@ -110,27 +177,76 @@ func debugRequest(request dns.Msg, question dns.Question) string {
 	return strings.Join(s, "")
 }
 
-func handleAXFR(writer dns.ResponseWriter, request *dns.Msg, storage Storage) error {
+// requestLog returns a logger for one request, carrying a new request id and
+// the fields that identify the request.
+func requestLog(writer dns.ResponseWriter, request *dns.Msg) *log.Entry {
+	client := writer.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	return NewRequestLog().WithFields(log.Fields{
+		"client":    client,
+		"transport": transport(writer),
+		"qname":     request.Question[0].Name,
+		"qtype":     dns.Type(request.Question[0].Qtype).String(),
+		"opcode":    dns.OpcodeToString[request.Opcode],
+	})
+}
+
+// logRequest writes the log line for a finished request
+func logRequest(logger *log.Entry, recorder *responseRecorder, start time.Time) {
+	logger.WithFields(log.Fields{
+		"rcode":    rcodeString(recorder.rcode),
+		"answers":  recorder.records,
+		"duration": time.Since(start).Seconds(),
+	}).Info("Answered request")
+}
+
+func handleAXFR(ctx context.Context, writer dns.ResponseWriter, request *dns.Msg, storage Storage) error {
+	logger := LoggerFrom(ctx)
 	zonename := request.Question[0].Name
-	log.Debug(fmt.Sprintf("Attempting AXFR for %s", zonename))
+	logger.Debug(fmt.Sprintf("Attempting AXFR for %s", zonename))
 
-	rrs, err := storage.Driver.GetFullAxfrRRs(zonename)
+	rrs, err := storage.Driver.GetFullAxfrRRs(ctx, zonename)
 	if err != nil {
 		return err
 	}
 
-	err = sendAxfr(writer, request, rrs)
+	if len(rrs) == 0 {
+		return errors.New("No records found in AXFR")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return errors.New("AXFR does not start with an SOA record")
+	}
+
+	var msgs [][]byte
+	if storage.AxfrCache != nil {
+		msgs = storage.AxfrCache.Get(zonename, soa.Serial)
+	}
+	if msgs == nil {
+		msgs, err = packAxfr(request, rrs)
+		if err != nil {
+			return err
+		}
+		if storage.AxfrCache != nil {
+			storage.AxfrCache.Put(zonename, soa.Serial, msgs)
+		}
+	}
+
+	err = sendAxfr(ctx, writer, request, msgs)
 	if err != nil {
 		return err
 	}
 
-	log.Info(fmt.Sprintf("Completed AXFR for %s", zonename))
+	logger.Info(fmt.Sprintf("Completed AXFR for %s", zonename))
 	return nil
 }
 
-func sendAxfr(writer dns.ResponseWriter, request *dns.Msg, rrs []dns.RR) error {
-	zonename := request.Question[0].Name
-	envelopes := []dns.Envelope{}
+// packAxfr splits the rrs into envelopes of 100, and packs each one as a
+// compressed reply to request.
+func packAxfr(request *dns.Msg, rrs []dns.RR) ([][]byte, error) {
+	msgs := [][]byte{}
 
 	SentRRs := 0
 	for SentRRs < len(rrs) {
@@ -138,38 +254,63 @@ func sendAxfr(writer dns.ResponseWriter, request *dns.Msg, rrs []dns.RR) error {
 		if SentRRs+RRsToSend > len(rrs) {
 			RRsToSend = len(rrs) - SentRRs
 		}
-		envelopes = append(envelopes, dns.Envelope{RR: rrs[SentRRs:(SentRRs + RRsToSend)]})
+
+		message := PrepReply(request)
+		message.Compress = true
+		message.Answer = append(message.Answer, rrs[SentRRs:(SentRRs+RRsToSend)]...)
+		packed, err := message.Pack()
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, packed)
 		SentRRs += RRsToSend
 	}
 
-	for _, envelope := range envelopes {
-		message := PrepReply(request)
-		message.Answer = append(message.Answer, envelope.RR...)
-		if err := writer.WriteMsg(message); err != nil {
-			log.Error(fmt.Sprintf("Error answering axfr for %s: %s", zonename, err))
+	return msgs, nil
+}
+
+// sendAxfr writes packed messages to the connection, with the header fields
+// from this request. It stops between messages once ctx is done, and the
+// connection is closed rather than answered, since the client has part of
+// the zone.
+func sendAxfr(ctx context.Context, writer dns.ResponseWriter, request *dns.Msg, msgs [][]byte) error {
+	logger := LoggerFrom(ctx)
+	zonename := request.Question[0].Name
+
+	for _, packed := range msgs {
+		if err := ctx.Err(); err != nil {
+			logger.Error(fmt.Sprintf("Abandoning axfr for %s: %s", zonename, err))
+			return err
+		}
+		msg := stampReply(packed, request.Id, request.RecursionDesired, request.CheckingDisabled)
+		if _, err := writer.Write(msg); err != nil {
+			logger.Error(fmt.Sprintf("Error answering axfr for %s: %s", zonename, err))
 			return err
 		}
 	}
 
 	return nil
-
 }
 
-func handleQuery(question dns.Question, message *dns.Msg, storage Storage) (*dns.Msg, error) {
+func handleQuery(ctx context.Context, question dns.Question, message *dns.Msg, storage Storage) (*dns.Msg, error) {
+	logger := LoggerFrom(ctx)
 	name := question.Name
 	RawRRType := question.Qtype
 
-	// catch a panic here
-	RRType := dns.TypeToString[RawRRType]
+	// Types miekg/dns doesn't know are named as in RFC 3597, e.g. TYPE65280
+	RRType := dns.Type(RawRRType).String()
 
-	log.Debug(fmt.Sprintf("Attempting %s query for %s", RRType, name))
-	rrs, err := storage.Driver.GetQueryRRs(name, RRType)
+	logger.Debug(fmt.Sprintf("Attempting %s query for %s", RRType, name))
+	rrs, err := storage.Driver.GetQueryRRs(ctx, name, RRType)
+	if err == ErrZoneRefused {
+		return message, errors.New("REFUSED")
+	}
 	if err != nil {
-		log.Error(fmt.Sprintf("There was a problem querying %s for %s", RRType, name))
+		logger.Error(fmt.Sprintf("There was a problem querying %s for %s", RRType, name))
 		return message, errors.New("SERVFAIL")
 	}
 
-	log.Info(fmt.Sprintf("Completed %s query for %s", RRType, name))
+	logger.Debug(fmt.Sprintf("Completed %s query for %s", RRType, name))
 	if len(rrs) == 0 {
 		return message, errors.New("REFUSED")
 	}
@@ -177,3 +318,82 @@ func handleQuery(question dns.Question, message *dns.Msg, storage Storage) (*dns
 	message.Answer = append(message.Answer, rrs...)
 	return message, nil
 }
+
+// zoneInvalidator is a Driver that caches zones, like CachingDriver.
+type zoneInvalidator interface {
+	Invalidate(zonename string)
+}
+
+// zoneNotifier is a Driver that transfers zones from masters, like
+// SecondaryDriver, or one that wraps such a driver. Masters returns the
+// masters of a zone it transfers, as host:port, or nil.
+type zoneNotifier interface {
+	Notify(zonename string)
+	Masters(zonename string) []string
+}
+
+// handleNotify acknowledges a NOTIFY for a zone mdns serves, and drops the
+// zone from the cache so the change is served without waiting for the next
+// serial poll. A secondary zone is checked against its masters straight
+// away. NOTIFYs for anything but the apex of a zone get NOTAUTH, and ones
+// from outside -notify_allow and the zone's masters, or for a zone in a shard
+// outside -shards, get REFUSED.
+func handleNotify(ctx context.Context, writer dns.ResponseWriter, request *dns.Msg, storage Storage) (*dns.Msg, error) {
+	logger := LoggerFrom(ctx)
+	name := request.Question[0].Name
+
+	zone, err := storage.Driver.FindZone(ctx, name)
+	if err == sql.ErrNoRows || (err == nil && !strings.EqualFold(zone.Name, name)) {
+		logger.Info(fmt.Sprintf("NOTIFY for %s, which is not a zone mdns serves", name))
+		return nil, errors.New("NOTAUTH")
+	}
+	if err != nil {
+		return nil, errors.New("SERVFAIL")
+	}
+	if !notifyAllowed(writer.RemoteAddr(), zone.Name, storage.Driver) {
+		logger.Warn(fmt.Sprintf("NOTIFY for %s from %s, which is not in -notify_allow or one of its masters", name, writer.RemoteAddr()))
+		return nil, errors.New("REFUSED")
+	}
+	if !ownsShard(zone.Shard) {
+		logger.Info(fmt.Sprintf("NOTIFY for %s, which is in shard %d, outside %s", name, zone.Shard, Conf.Shards))
+		return nil, errors.New("REFUSED")
+	}
+
+	if cache, ok := storage.Driver.(zoneInvalidator); ok {
+		cache.Invalidate(zone.Name)
+	}
+	if secondary, ok := storage.Driver.(zoneNotifier); ok {
+		secondary.Notify(zone.Name)
+	}
+	logger.Info(fmt.Sprintf("NOTIFY for %s acknowledged", zone.Name))
+	return PrepReply(request), nil
+}
+
+// notifyAllowed reports whether a NOTIFY for zonename may come from remote:
+// an address in -notify_allow, or one of the zone's masters if it is a
+// secondary zone. Masters given by hostname aren't resolved.
+func notifyAllowed(remote net.Addr, zonename string, driver Driver) bool {
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, allowed := range Conf.NotifyAllow {
+		if allowed.Contains(ip) {
+			return true
+		}
+	}
+	if secondary, ok := driver.(zoneNotifier); ok {
+		for _, master := range secondary.Masters(zonename) {
+			host, _, err := net.SplitHostPort(master)
+			if err == nil && ip.Equal(net.ParseIP(host)) {
+				return true
+			}
+		}
+	}
+	return false
+}
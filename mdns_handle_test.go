@@ -1,19 +1,25 @@
 package mdns_test
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/rackerlabs/mdns"
+	"github.com/rackerlabs/mdns/mdnstest"
 )
 
 // A 'fake' dns.ResponseWriter https://github.com/miekg/dns/blob/master/server.go#L24
 // is needed to pass into our DNS Handler function.
 type FakeResponseWriter struct {
 	writtenMsgs []dns.Msg
+	// failAfter makes Write fail once that many messages are written
+	failAfter int
+	closed    bool
 }
 
 func (writer *FakeResponseWriter) LocalAddr() net.Addr {
@@ -33,9 +39,22 @@ func (writer *FakeResponseWriter) WriteMsg(message *dns.Msg) error {
 
 func (writer *FakeResponseWriter) GetMsgs() []dns.Msg { return writer.writtenMsgs }
 
-func (writer *FakeResponseWriter) Write(stuff []byte) (int, error) { return 0, nil }
+func (writer *FakeResponseWriter) Write(stuff []byte) (int, error) {
+	if writer.failAfter > 0 && len(writer.writtenMsgs) >= writer.failAfter {
+		return 0, errors.New("connection reset")
+	}
+	message := dns.Msg{}
+	if err := message.Unpack(stuff); err != nil {
+		return 0, err
+	}
+	writer.writtenMsgs = append(writer.writtenMsgs, message)
+	return len(stuff), nil
+}
 
-func (writer *FakeResponseWriter) Close() error { return nil }
+func (writer *FakeResponseWriter) Close() error {
+	writer.closed = true
+	return nil
+}
 
 func (writer *FakeResponseWriter) TsigStatus() error { return nil }
 
@@ -68,39 +87,64 @@ func generateMsg(name string, qtype uint16, opcode int) dns.Msg {
 	}
 }
 
-func TestHandleInvalidOpcode(t *testing.T) {
+// gomdnsZone is the gomdns.com. zone of the test database, for the tests
+// that run a server on a MemoryDriver.
+const gomdnsZone = `$ORIGIN gomdns.com.
+@	3600 IN SOA ns1.designate.com. hostmaster.gomdns.com. 1458672783 3600 600 86400 3600
+@	3600 IN NS ns1.designate.com.
+`
+
+func openGomdns(t *testing.T) *mdns.MemoryDriver {
 	SetUp()
+	memory := mdns.NewMemoryDriver()
+	ok(t, memory.SetZoneText("gomdns.com.", gomdnsZone))
+	return memory
+}
 
-	mysql := &mdns.MySQLDriver{}
-	ok(t, mysql.Open())
+func startServer(t *testing.T, storage mdns.Storage) (string, func()) {
+	addr, stop, err := mdnstest.Start(storage)
+	ok(t, err)
+	return addr, stop
+}
 
-	storage := mdns.Storage{Driver: mysql}
-	handler := mdns.NewDefaultMdnsHandler(storage)
+func exchange(t *testing.T, addr string, msg dns.Msg) *dns.Msg {
+	answer, _, err := (&dns.Client{Timeout: time.Second}).Exchange(&msg, addr)
+	ok(t, err)
+	return answer
+}
+
+func transfer(t *testing.T, addr string, zonename string) []*dns.Envelope {
+	msg := new(dns.Msg)
+	msg.SetAxfr(zonename)
+	channel, err := (&dns.Transfer{ReadTimeout: time.Second}).In(msg, addr)
+	ok(t, err)
+	envelopes := []*dns.Envelope{}
+	for envelope := range channel {
+		ok(t, envelope.Error)
+		envelopes = append(envelopes, envelope)
+	}
+	return envelopes
+}
+
+func TestHandleInvalidOpcode(t *testing.T) {
+	// A server answers UPDATEs with NOTIMP before they reach the handler, so
+	// call it directly
+	handler := mdns.NewDefaultMdnsHandler(mdns.Storage{Driver: openGomdns(t)})
 	fakeWriter := &FakeResponseWriter{}
 	// Send a message that mdns won't handle
 	msg := generateMsg("gomdns.com.", dns.TypeNone, dns.OpcodeUpdate)
 
 	handler.ServeDNS(fakeWriter, &msg)
-	results := fakeWriter.GetMsgs()
-	answer := results[0]
+	answer := fakeWriter.GetMsgs()[0]
 	assert(t, answer.Rcode == dns.RcodeRefused, fmt.Sprintf("Rcode should be 5, it was: %d", answer.Rcode))
 }
 
 func TestHandleSoaQuery(t *testing.T) {
-	SetUp()
-
-	mysql := &mdns.MySQLDriver{}
-	ok(t, mysql.Open())
+	addr, stop := startServer(t, mdns.Storage{Driver: openGomdns(t)})
+	defer stop()
 
-	storage := mdns.Storage{Driver: mysql}
-	handler := mdns.NewDefaultMdnsHandler(storage)
-	fakeWriter := &FakeResponseWriter{}
-	// Send a message that mdns won't handle
 	msg := generateMsg("gomdns.com.", dns.TypeSOA, dns.OpcodeQuery)
-
-	handler.ServeDNS(fakeWriter, &msg)
-	results := fakeWriter.GetMsgs()
-	answer := results[0]
+	answer := exchange(t, addr, msg)
 	assert(t, answer.Rcode == dns.RcodeSuccess, fmt.Sprintf("Rcode should be 0, it was: %d", answer.Rcode))
 	assert(t, len(answer.Answer) == 1, fmt.Sprintf("Answer was >1 record: %d", len(answer.Answer)))
 	serial := answer.Answer[0].(*dns.SOA).Serial
@@ -109,33 +153,71 @@ func TestHandleSoaQuery(t *testing.T) {
 }
 
 func TestHandleAxfr(t *testing.T) {
-	SetUp()
-
-	mysql := &mdns.MySQLDriver{}
-	ok(t, mysql.Open())
+	addr, stop := startServer(t, mdns.Storage{Driver: openGomdns(t)})
+	defer stop()
 
-	storage := mdns.Storage{Driver: mysql}
-	handler := mdns.NewDefaultMdnsHandler(storage)
-	fakeWriter := &FakeResponseWriter{}
-	// Send a message that mdns won't handle
-	msg := generateMsg("gomdns.com.", dns.TypeAXFR, dns.OpcodeQuery)
-
-	handler.ServeDNS(fakeWriter, &msg)
-	results := fakeWriter.GetMsgs()
-	answer := results[0]
-	assert(t, answer.Rcode == dns.RcodeSuccess, fmt.Sprintf("Rcode should be 0, it was: %d", answer.Rcode))
-	assert(t, len(answer.Answer) == 3, fmt.Sprintf("Answer length != 3 records: %d", len(answer.Answer)))
-	serial := answer.Answer[0].(*dns.SOA).Serial
+	envelopes := transfer(t, addr, "gomdns.com.")
+	equals(t, 1, len(envelopes))
+	answer := envelopes[0].RR
+	assert(t, len(answer) == 3, fmt.Sprintf("Answer length != 3 records: %d", len(answer)))
+	serial := answer[0].(*dns.SOA).Serial
 	assert(t, serial == 1458672783,
 		fmt.Sprintf("Wrong serial number, expected 1458672783, got: %d", serial))
-	assert(t, answer.Answer[1].String() == "gomdns.com.\t3600\tIN\tNS\tns1.designate.com.",
+	assert(t, answer[1].String() == "gomdns.com.\t3600\tIN\tNS\tns1.designate.com.",
 		fmt.Sprintf("bad NS record, expecting gomdns.com.\t3600\tIN\tNS\tns1.designate.com. got :%s",
-			answer.Answer[1].String()))
-	serial = answer.Answer[2].(*dns.SOA).Serial
+			answer[1].String()))
+	serial = answer[2].(*dns.SOA).Serial
 	assert(t, serial == 1458672783,
 		fmt.Sprintf("Wrong serial number, expected 1458672783, got: %d", serial))
 }
 
+func TestHandleAxfrCached(t *testing.T) {
+	storage := mdns.Storage{Driver: openGomdns(t), AxfrCache: mdns.NewAxfrCache(1 << 20)}
+	addr, stop := startServer(t, storage)
+	defer stop()
+
+	transfer(t, addr, "gomdns.com.")
+	assert(t, storage.AxfrCache.Stats().Entries == 1, "The AXFR should have been cached")
+
+	// The cached messages have to carry the id of the new request, which
+	// dns.Transfer checks
+	envelopes := transfer(t, addr, "gomdns.com.")
+	answer := envelopes[0].RR
+	assert(t, len(answer) == 3, fmt.Sprintf("Answer length != 3 records: %d", len(answer)))
+}
+
+func TestHandleAxfrFailsPartWay(t *testing.T) {
+	memory := openGomdns(t)
+	zone := gomdnsZone
+	for i := 0; i < 150; i++ {
+		zone += fmt.Sprintf("host%d 300 IN A 192.0.2.%d\n", i, i%250)
+	}
+	ok(t, memory.SetZoneText("gomdns.com.", zone))
+
+	handler := mdns.NewDefaultMdnsHandler(mdns.Storage{Driver: memory})
+	fakeWriter := &FakeResponseWriter{failAfter: 1}
+	msg := generateMsg("gomdns.com.", dns.TypeAXFR, dns.OpcodeQuery)
+	handler.ServeDNS(fakeWriter, &msg)
+
+	// The first envelope went out, so no SERVFAIL follows it
+	equals(t, 1, len(fakeWriter.GetMsgs()))
+	equals(t, dns.RcodeSuccess, fakeWriter.GetMsgs()[0].Rcode)
+	assert(t, fakeWriter.closed, "the connection should have been closed")
+}
+
+func TestHandleUnknownType(t *testing.T) {
+	memory := openGomdns(t)
+	ok(t, memory.SetZoneText("gomdns.com.", gomdnsZone+"generic 300 IN TYPE65280 \\# 4 0A000001\n"))
+	addr, stop := startServer(t, mdns.Storage{Driver: memory})
+	defer stop()
+
+	msg := generateMsg("generic.gomdns.com.", 65280, dns.OpcodeQuery)
+	answer := exchange(t, addr, msg)
+	equals(t, dns.RcodeSuccess, answer.Rcode)
+	equals(t, 1, len(answer.Answer))
+	equals(t, "0a000001", answer.Answer[0].(*dns.RFC3597).Rdata)
+}
+
 func benchmarkAxfr(zonename string, b *testing.B) {
 	SetTestConfig()
 	log.SetLevel(log.ErrorLevel)
@@ -155,3 +237,105 @@ func benchmarkAxfr(zonename string, b *testing.B) {
 
 func BenchmarkSmallAxfr(b *testing.B) { benchmarkAxfr("gomdns.com.", b) }
 func BenchmarkLargeAxfr(b *testing.B) { benchmarkAxfr("testbigdomain28580535.com.", b) }
+
+func TestHandleQueryTimeout(t *testing.T) {
+	mysql, primary, replicas := openFake(t, "timeout")
+	defer mysql.Close()
+	mdns.Conf.QueryTimeout = 50 * time.Millisecond
+	endpoints := append([]string{primary}, replicas...)
+	for _, dsn := range endpoints {
+		fakeDB.setSlow(dsn, 5*time.Second)
+	}
+
+	handler := mdns.NewDefaultMdnsHandler(mdns.Storage{Driver: mysql})
+	fakeWriter := &FakeResponseWriter{}
+	msg := generateMsg("gomdns.com.", dns.TypeSOA, dns.OpcodeQuery)
+	msg.SetEdns0(4096, false)
+
+	start := time.Now()
+	handler.ServeDNS(fakeWriter, &msg)
+	assert(t, time.Since(start) < time.Second, "query was not cut short: %s", time.Since(start))
+
+	answer := fakeWriter.GetMsgs()[0]
+	equals(t, dns.RcodeServerFailure, answer.Rcode)
+	opt := answer.IsEdns0()
+	assert(t, opt != nil, "SERVFAIL has no OPT record")
+	equals(t, 1, len(opt.Option))
+	ede, isEde := opt.Option[0].(*dns.EDNS0_EDE)
+	assert(t, isEde, "expected an Extended DNS Error, got %#v", opt.Option[0])
+	equals(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+
+	// The query was cancelled in the database, and didn't eject anything
+	cancelled := func() int {
+		total := 0
+		for _, dsn := range endpoints {
+			total += fakeDB.wasCancelled(dsn)
+		}
+		return total
+	}
+	deadline := time.Now().Add(time.Second)
+	for cancelled() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	equals(t, 1, cancelled())
+	equals(t, map[string]bool{"primary": true, "replica0": true, "replica1": true}, healthy(mysql))
+}
+
+func TestHandleQueryTimeoutWithoutEdns(t *testing.T) {
+	mysql, primary, replicas := openFake(t, "timeout-noedns")
+	defer mysql.Close()
+	mdns.Conf.QueryTimeout = 50 * time.Millisecond
+	for _, dsn := range append([]string{primary}, replicas...) {
+		fakeDB.setSlow(dsn, 5*time.Second)
+	}
+
+	handler := mdns.NewDefaultMdnsHandler(mdns.Storage{Driver: mysql})
+	fakeWriter := &FakeResponseWriter{}
+	msg := generateMsg("gomdns.com.", dns.TypeSOA, dns.OpcodeQuery)
+
+	handler.ServeDNS(fakeWriter, &msg)
+	answer := fakeWriter.GetMsgs()[0]
+	equals(t, dns.RcodeServerFailure, answer.Rcode)
+	assert(t, answer.IsEdns0() == nil, "client without EDNS got an OPT record")
+}
+
+func TestHandleNotify(t *testing.T) {
+	cache := mdns.NewCachingDriver(openGomdns(t), 1<<20)
+	_, err := cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	equals(t, 1, cache.Stats().Entries)
+
+	addr, stop := startServer(t, mdns.Storage{Driver: cache})
+	defer stop()
+
+	msg := generateMsg("gomdns.com.", dns.TypeSOA, dns.OpcodeNotify)
+	answer := exchange(t, addr, msg)
+	equals(t, dns.RcodeSuccess, answer.Rcode)
+	equals(t, dns.OpcodeNotify, answer.Opcode)
+	assert(t, answer.Authoritative, "NOTIFY response should be authoritative")
+	equals(t, 0, cache.Stats().Entries)
+}
+
+func TestHandleNotifyNotAllowed(t *testing.T) {
+	cache := mdns.NewCachingDriver(openGomdns(t), 1<<20)
+	nets, err := mdns.ParseNotifyAllow("192.0.2.0/24")
+	ok(t, err)
+	mdns.Conf.NotifyAllow = nets
+	_, err = cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+
+	addr, stop := startServer(t, mdns.Storage{Driver: cache})
+	defer stop()
+
+	msg := generateMsg("gomdns.com.", dns.TypeSOA, dns.OpcodeNotify)
+	equals(t, dns.RcodeRefused, exchange(t, addr, msg).Rcode)
+	equals(t, 1, cache.Stats().Entries)
+}
+
+func TestHandleNotifyUnknownZone(t *testing.T) {
+	addr, stop := startServer(t, mdns.Storage{Driver: openGomdns(t)})
+	defer stop()
+
+	msg := generateMsg("example.org.", dns.TypeSOA, dns.OpcodeNotify)
+	equals(t, dns.RcodeNotAuth, exchange(t, addr, msg).Rcode)
+}
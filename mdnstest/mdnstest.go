@@ -0,0 +1,84 @@
+// Package mdnstest runs real mdns servers for tests, without a database.
+//
+//	addr, stop, err := mdnstest.StartZones(map[string]string{
+//		"example.com.": "@ 3600 IN SOA ns1 hostmaster 1 3600 600 86400 300\n" +
+//			"www 300 IN A 192.0.2.1\n",
+//	})
+//	defer stop()
+//
+// addr is an ephemeral port on 127.0.0.1, answering over both UDP and TCP.
+package mdnstest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"github.com/rackerlabs/mdns"
+)
+
+// How many ephemeral ports to try before giving up on finding one free for
+// both UDP and TCP
+const attempts = 10
+
+// Start serves storage over UDP and TCP, on the same ephemeral port of
+// 127.0.0.1. It returns the address, and a func that stops the server.
+func Start(storage mdns.Storage) (string, func(), error) {
+	handler := mdns.NewDefaultMdnsHandler(storage)
+	var err error
+	for i := 0; i < attempts; i++ {
+		var port int
+		port, err = freePort()
+		if err != nil {
+			continue
+		}
+		host := mdns.ListenAddr{Host: "127.0.0.1", Port: strconv.Itoa(port)}
+		tcp, udp := host, host
+		tcp.Net, udp.Net = "tcp", "udp"
+
+		var listeners *mdns.Listeners
+		listeners, err = mdns.Serve([]mdns.ListenAddr{tcp, udp}, handler)
+		if err != nil {
+			// Something else took the port in the meantime
+			continue
+		}
+		return host.Addr(), listeners.Shutdown, nil
+	}
+	return "", nil, fmt.Errorf("couldn't find a free port for mdns: %s", err)
+}
+
+// StartZones serves zones from memory, given as zone file text keyed by
+// each zone's origin.
+func StartZones(zones map[string]string) (string, func(), error) {
+	memory := mdns.NewMemoryDriver()
+	for origin, text := range zones {
+		if err := memory.SetZoneText(origin, text); err != nil {
+			return "", nil, fmt.Errorf("zone %s: %s", origin, err)
+		}
+	}
+	return Start(mdns.Storage{Driver: memory})
+}
+
+// StartRRs serves zones from memory, each given as its records, SOA
+// included.
+func StartRRs(zones ...[]dns.RR) (string, func(), error) {
+	memory := mdns.NewMemoryDriver()
+	for _, rrs := range zones {
+		if err := memory.SetZone(rrs); err != nil {
+			return "", nil, err
+		}
+	}
+	return Start(mdns.Storage{Driver: memory})
+}
+
+// freePort asks the kernel for a TCP port no one is using. The port is
+// free for UDP too, more often than not.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,76 @@
+package mdnstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rackerlabs/mdns/mdnstest"
+)
+
+const zone = `@	3600 IN SOA ns1 hostmaster 1 3600 600 86400 300
+@	3600 IN NS ns1
+ns1	3600 IN A 192.0.2.53
+www	300 IN A 192.0.2.1
+`
+
+func query(t *testing.T, net string, addr string, name string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	answer, _, err := (&dns.Client{Net: net, Timeout: time.Second}).Exchange(msg, addr)
+	if err != nil {
+		t.Fatalf("%s query for %s: %s", net, name, err)
+	}
+	return answer
+}
+
+func TestStartZones(t *testing.T) {
+	addr, stop, err := mdnstest.StartZones(map[string]string{"example.com.": zone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for _, net := range []string{"udp", "tcp"} {
+		answer := query(t, net, addr, "www.example.com.")
+		if answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 1 {
+			t.Fatalf("%s: expected one answer, got %s", net, answer)
+		}
+		if a := answer.Answer[0].(*dns.A).A.String(); a != "192.0.2.1" {
+			t.Fatalf("%s: expected 192.0.2.1, got %s", net, a)
+		}
+	}
+}
+
+func TestStartRRs(t *testing.T) {
+	rrs := []dns.RR{}
+	for _, record := range []string{
+		"example.net. 3600 IN SOA ns1.example.net. hostmaster.example.net. 1 3600 600 86400 300",
+		"www.example.net. 300 IN A 192.0.2.2",
+	} {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	addr, stop, err := mdnstest.StartRRs(rrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if answer := query(t, "udp", addr, "www.example.net."); len(answer.Answer) != 1 {
+		t.Fatalf("expected one answer, got %s", answer)
+	}
+	if answer := query(t, "udp", addr, "www.example.org."); answer.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED outside the zone, got %s", dns.RcodeToString[answer.Rcode])
+	}
+}
+
+func TestStartZonesInvalid(t *testing.T) {
+	_, _, err := mdnstest.StartZones(map[string]string{"example.com.": "www IN A 192.0.2.1\n"})
+	if err == nil {
+		t.Fatal("a zone without an SOA should be refused")
+	}
+}
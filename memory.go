@@ -0,0 +1,191 @@
+package mdns
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"strings"
+	"sync"
+)
+
+//
+// Memory Driver
+//
+
+// MemoryDriver serves zones held in memory, set from records or zone file
+// text. It needs no database, which makes it handy for tests. Zones are
+// answered exactly as the MySQL driver answers them, with sql.ErrNoRows for
+// an AXFR of a zone it doesn't have.
+type MemoryDriver struct {
+	mutex sync.Mutex
+	zones map[string]*memoryZone
+}
+
+// memoryZone is one zone, with rrs in AXFR order, the SOA at both ends.
+type memoryZone struct {
+	zone Zone
+	rrs  []dns.RR
+}
+
+func NewMemoryDriver() *MemoryDriver {
+	return &MemoryDriver{zones: map[string]*memoryZone{}}
+}
+
+// SetZone adds a zone, or replaces it. The zone is named by its SOA, and
+// rrs must have exactly one, with every other record under it.
+func (memory *MemoryDriver) SetZone(rrs []dns.RR) error {
+	rrs, err := axfrOrder(rrs)
+	if err != nil {
+		return err
+	}
+	memory.setZone(rrs)
+	return nil
+}
+
+// SetZoneText adds a zone, or replaces it, from the text of a zone file.
+// origin is the zone's name, and the origin of relative names in text.
+func (memory *MemoryDriver) SetZoneText(origin string, text string) error {
+	rrs, err := parseZone(strings.NewReader(text), origin, "")
+	if err != nil {
+		return err
+	}
+	memory.setZone(rrs)
+	return nil
+}
+
+// setZone stores rrs, which are already in AXFR order.
+func (memory *MemoryDriver) setZone(rrs []dns.RR) {
+	soa := rrs[0].(*dns.SOA)
+	zone := Zone{
+		Id:      strings.ToLower(soa.Hdr.Name),
+		Name:    strings.ToLower(soa.Hdr.Name),
+		Ttl:     int64(soa.Hdr.Ttl),
+		Status:  "ACTIVE",
+		Action:  "NONE",
+		Serial:  soa.Serial,
+		Email:   soa.Mbox,
+		Refresh: int64(soa.Refresh),
+		Retry:   int64(soa.Retry),
+		Expire:  int64(soa.Expire),
+		Minimum: int64(soa.Minttl),
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	memory.zones[zone.Name] = &memoryZone{zone: zone, rrs: rrs}
+}
+
+// RemoveZone stops serving a zone.
+func (memory *MemoryDriver) RemoveZone(zonename string) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	delete(memory.zones, strings.ToLower(dns.Fqdn(zonename)))
+}
+
+func (memory *MemoryDriver) Open() error {
+	return nil
+}
+
+func (memory *MemoryDriver) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (memory *MemoryDriver) lookup(zonename string) (*memoryZone, bool) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	zone, ok := memory.zones[strings.ToLower(dns.Fqdn(zonename))]
+	return zone, ok
+}
+
+// FindZone returns the closest zone enclosing qname.
+func (memory *MemoryDriver) FindZone(ctx context.Context, qname string) (Zone, error) {
+	for _, suffix := range nameSuffixes(qname) {
+		if zone, ok := memory.lookup(suffix); ok {
+			return zone.zone, nil
+		}
+	}
+	return Zone{}, sql.ErrNoRows
+}
+
+func (memory *MemoryDriver) GetFullAxfrRRs(ctx context.Context, zonename string) ([]dns.RR, error) {
+	zone, ok := memory.lookup(zonename)
+	if !ok {
+		LoggerFrom(ctx).Debug(fmt.Sprintf("No zone %s", zonename))
+		return nil, sql.ErrNoRows
+	}
+	return zone.rrs, nil
+}
+
+func (memory *MemoryDriver) GetQueryRRs(ctx context.Context, RRName string, RRType string) ([]dns.RR, error) {
+	found, err := memory.FindZone(ctx, RRName)
+	if err != nil {
+		return nil, nil
+	}
+	zone, ok := memory.lookup(found.Name)
+	if !ok {
+		return nil, nil
+	}
+	return axfrAnswers(zone.rrs, RRName, RRType), nil
+}
+
+func (memory *MemoryDriver) GetZoneSerials(ctx context.Context) (map[string]uint32, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	serials := map[string]uint32{}
+	for name, zone := range memory.zones {
+		serials[name] = zone.zone.Serial
+	}
+	return serials, nil
+}
+
+// parseZone parses a zone file for the zone origin, returning it in AXFR
+// order. file is only used in errors.
+func parseZone(r io.Reader, origin string, file string) ([]dns.RR, error) {
+	origin = dns.Fqdn(origin)
+	rrs := []dns.RR{}
+	parser := dns.NewZoneParser(r, origin, file)
+	for rr, more := parser.Next(); more; rr, more = parser.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+
+	rrs, err := axfrOrder(rrs)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(rrs[0].Header().Name, origin) {
+		return nil, fmt.Errorf("SOA record for %s is not at the apex of %s", rrs[0].Header().Name, origin)
+	}
+	return rrs, nil
+}
+
+// axfrOrder checks that rrs is one zone, with exactly one SOA and every
+// other record under it, and returns it with the SOA at both ends.
+func axfrOrder(rrs []dns.RR) ([]dns.RR, error) {
+	var soa *dns.SOA
+	records := []dns.RR{}
+	for _, rr := range rrs {
+		if found, ok := rr.(*dns.SOA); ok {
+			if soa != nil {
+				return nil, errors.New("more than one SOA record")
+			}
+			soa = found
+			continue
+		}
+		records = append(records, rr)
+	}
+	if soa == nil {
+		return nil, errors.New("no SOA record")
+	}
+	for _, rr := range records {
+		if !dns.IsSubDomain(soa.Hdr.Name, rr.Header().Name) {
+			return nil, fmt.Errorf("%s is outside the zone %s", rr.Header().Name, soa.Hdr.Name)
+		}
+	}
+	return append(append([]dns.RR{soa}, records...), soa), nil
+}
@@ -0,0 +1,51 @@
+package mdns_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rackerlabs/mdns"
+)
+
+func TestMemoryDriver(t *testing.T) {
+	memory := openGomdns(t)
+	ctx := mdns.NewRequestContext()
+
+	zone, err := memory.FindZone(ctx, "www.GoMDNS.com.")
+	ok(t, err)
+	equals(t, "gomdns.com.", zone.Name)
+	equals(t, uint32(1458672783), zone.Serial)
+
+	rrs, err := memory.GetQueryRRs(ctx, "gomdns.com.", "NS")
+	ok(t, err)
+	equals(t, 1, len(rrs))
+
+	memory.RemoveZone("gomdns.com.")
+	_, err = memory.GetFullAxfrRRs(ctx, "gomdns.com.")
+	equals(t, sql.ErrNoRows, err)
+	_, err = memory.FindZone(ctx, "gomdns.com.")
+	equals(t, sql.ErrNoRows, err)
+}
+
+func TestMemoryDriverSetZone(t *testing.T) {
+	memory := mdns.NewMemoryDriver()
+	newRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		ok(t, err)
+		return rr
+	}
+	soa := newRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300")
+	www := newRR("www.example.com. 300 IN A 192.0.2.1")
+
+	ok(t, memory.SetZone([]dns.RR{www, soa}))
+	rrs, err := memory.GetFullAxfrRRs(mdns.NewRequestContext(), "example.com.")
+	ok(t, err)
+	equals(t, []dns.RR{soa, www, soa}, rrs)
+
+	assert(t, memory.SetZone([]dns.RR{www}) != nil, "a zone without an SOA should be refused")
+	assert(t, memory.SetZone([]dns.RR{soa, soa}) != nil, "a zone with two SOAs should be refused")
+	outside := newRR("www.example.net. 300 IN A 192.0.2.1")
+	assert(t, memory.SetZone([]dns.RR{soa, outside}) != nil, "a record outside the zone should be refused")
+	assert(t, memory.SetZoneText("example.org.", "www IN A not-an-address\n") != nil, "a zone that fails to parse should be refused")
+}
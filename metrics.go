@@ -0,0 +1,198 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"time"
+)
+
+//
+// Metrics
+//
+
+var (
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "queries_total",
+		Help:      "DNS requests answered, by qtype, rcode and transport.",
+	}, []string{"qtype", "rcode", "transport"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mdns",
+		Name:      "query_duration_seconds",
+		Help:      "Time taken to answer non-AXFR requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"transport"})
+
+	axfrDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mdns",
+		Name:      "axfr_duration_seconds",
+		Help:      "Time taken to complete an AXFR.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	})
+
+	axfrRecords = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mdns",
+		Name:      "axfr_records",
+		Help:      "Records sent per AXFR.",
+		Buckets:   prometheus.ExponentialBuckets(4, 4, 10),
+	})
+
+	axfrBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mdns",
+		Name:      "axfr_bytes",
+		Help:      "Bytes sent per AXFR.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	})
+
+	axfrInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mdns",
+		Name:      "axfr_in_flight",
+		Help:      "AXFRs currently being sent.",
+	})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mdns",
+		Name:      "db_query_duration_seconds",
+		Help:      "Time taken by database queries, by query.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"query"})
+
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "db_errors_total",
+		Help:      "Database queries that returned an error, by query.",
+	}, []string{"query"})
+
+	dbCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "db_coalesced_lookups_total",
+		Help:      "Lookups that shared the result of an identical concurrent lookup.",
+	})
+
+	dbEndpointHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mdns",
+		Name:      "db_endpoint_healthy",
+		Help:      "Whether a database endpoint is in rotation (1) or ejected (0).",
+	}, []string{"endpoint"})
+
+	dbEndpointEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "db_endpoint_ejections_total",
+		Help:      "Times a database endpoint was ejected after repeated errors.",
+	}, []string{"endpoint"})
+
+	badRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "bad_records_total",
+		Help:      "Times a record was skipped, or failed a lookup with -strict_records, because its data doesn't parse, by record type.",
+	}, []string{"type"})
+
+	dbOpenConnections = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "mdns",
+		Name:      "db_open_connections",
+		Help:      "Open connections to the database.",
+	}, func() float64 { return float64(dbStats().OpenConnections) })
+)
+
+func init() {
+	prometheus.MustRegister(
+		queriesTotal,
+		queryDuration,
+		axfrDuration,
+		axfrRecords,
+		axfrBytes,
+		axfrInFlight,
+		dbQueryDuration,
+		dbErrors,
+		dbCoalesced,
+		dbEndpointHealthy,
+		dbEndpointEjections,
+		badRecords,
+		dbOpenConnections,
+	)
+}
+
+// observeDBQuery records how long a database query took, and whether it failed.
+func observeDBQuery(query string, start time.Time, err error) {
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbErrors.WithLabelValues(query).Inc()
+	}
+}
+
+// responseRecorder wraps a dns.ResponseWriter to keep track of what was sent
+// for a request, so it can be counted once the handler is done.
+// If it has a Tapper, every response is also sent to dnstap.
+type responseRecorder struct {
+	dns.ResponseWriter
+	rcode    int
+	written  bool
+	records  int
+	bytes    int
+	tap      *Tapper
+	received time.Time
+}
+
+func (recorder *responseRecorder) WriteMsg(message *dns.Msg) error {
+	if !recorder.written {
+		recorder.rcode = message.Rcode
+		recorder.written = true
+	}
+	recorder.records += len(message.Answer)
+	recorder.bytes += message.Len()
+	if recorder.tap != nil {
+		recorder.tap.TapResponse(recorder.ResponseWriter, message, nil, recorder.received)
+	}
+	return recorder.ResponseWriter.WriteMsg(message)
+}
+
+// Write is used for messages that are already packed, like cached AXFRs.
+func (recorder *responseRecorder) Write(msg []byte) (int, error) {
+	if len(msg) >= 12 {
+		if !recorder.written {
+			recorder.rcode = int(msg[3] & 0x0F)
+			recorder.written = true
+		}
+		recorder.records += int(binary.BigEndian.Uint16(msg[6:8]))
+	}
+	recorder.bytes += len(msg)
+	if recorder.tap != nil {
+		recorder.tap.TapResponse(recorder.ResponseWriter, nil, msg, recorder.received)
+	}
+	return recorder.ResponseWriter.Write(msg)
+}
+
+func transport(writer dns.ResponseWriter) string {
+	switch writer.LocalAddr().(type) {
+	case *net.TCPAddr:
+		return "tcp"
+	case *net.UDPAddr:
+		return "udp"
+	}
+	return "unknown"
+}
+
+func rcodeString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+func observeRequest(recorder *responseRecorder, question dns.Question, start time.Time) {
+	network := transport(recorder)
+	elapsed := time.Since(start).Seconds()
+
+	queriesTotal.WithLabelValues(dns.Type(question.Qtype).String(), rcodeString(recorder.rcode), network).Inc()
+	if question.Qtype == dns.TypeAXFR && recorder.rcode == dns.RcodeSuccess {
+		axfrDuration.Observe(elapsed)
+		axfrRecords.Observe(float64(recorder.records))
+		axfrBytes.Observe(float64(recorder.bytes))
+	} else {
+		queryDuration.WithLabelValues(network).Observe(elapsed)
+	}
+}
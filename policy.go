@@ -0,0 +1,136 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//
+// Status Policy
+//
+
+// ErrZoneRefused is returned for a zone the status policy won't serve, or
+// that is in a shard outside -shards. It is answered with REFUSED.
+var ErrZoneRefused = errors.New("zone is refused")
+
+// Verdict is what a Policy decides to do with a zone or record.
+type Verdict int
+
+const (
+	// VerdictServe serves the zone or record as normal.
+	VerdictServe Verdict = iota
+	// VerdictRefuse answers REFUSED for anything in the zone. Zones only.
+	VerdictRefuse
+	// VerdictExclude leaves the record out of answers. Records only.
+	VerdictExclude
+)
+
+// Rule matches a Designate status and action. An empty Status or Action
+// matches any value.
+type Rule struct {
+	Status  string
+	Action  string
+	Verdict Verdict
+}
+
+func (rule Rule) matches(status, action string) bool {
+	return (rule.Status == "" || rule.Status == status) &&
+		(rule.Action == "" || rule.Action == action)
+}
+
+// Policy decides how zones and records are served, from their status and
+// action. The first matching rule wins, and anything no rule matches is
+// served. The same policy applies to queries and AXFRs.
+type Policy struct {
+	Name    string
+	Zones   []Rule
+	Records []Rule
+}
+
+func verdict(rules []Rule, status, action string) Verdict {
+	for _, rule := range rules {
+		if rule.matches(status, action) {
+			return rule.Verdict
+		}
+	}
+	return VerdictServe
+}
+
+func (policy *Policy) ZoneVerdict(status, action string) Verdict {
+	return verdict(policy.Zones, status, action)
+}
+
+func (policy *Policy) RecordVerdict(status, action string) Verdict {
+	return verdict(policy.Records, status, action)
+}
+
+// filterRecords drops the records the policy excludes.
+func (policy *Policy) filterRecords(rrs []RR) []RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if policy.RecordVerdict(rr.Status, rr.Action) != VerdictExclude {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// Policies are the status policies that can be chosen with -status_policy.
+var Policies = map[string]*Policy{
+	// designate serves zones while Designate is still pushing them out
+	// (PENDING), since that is when backends transfer them from mdns.
+	"designate": &Policy{
+		Name: "designate",
+		Zones: []Rule{
+			{Status: "ERROR", Verdict: VerdictRefuse},
+			{Status: "DELETED", Verdict: VerdictRefuse},
+		},
+		Records: []Rule{
+			{Action: "DELETE", Verdict: VerdictExclude},
+			{Status: "DELETED", Verdict: VerdictExclude},
+		},
+	},
+	// active_only serves only what Designate has finished pushing out.
+	"active_only": &Policy{
+		Name: "active_only",
+		Zones: []Rule{
+			{Status: "ACTIVE", Verdict: VerdictServe},
+			{Verdict: VerdictRefuse},
+		},
+		Records: []Rule{
+			{Action: "DELETE", Verdict: VerdictExclude},
+			{Status: "ACTIVE", Verdict: VerdictServe},
+			{Verdict: VerdictExclude},
+		},
+	},
+}
+
+// DefaultPolicy is used when no -status_policy is set.
+const DefaultPolicy = "designate"
+
+// PolicyByName returns the named status policy. An empty name is the default.
+func PolicyByName(name string) (*Policy, error) {
+	if name == "" {
+		name = DefaultPolicy
+	}
+	policy, ok := Policies[name]
+	if !ok {
+		names := []string{}
+		for known := range Policies {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown status policy %q, expected one of %v", name, names)
+	}
+	return policy, nil
+}
+
+// currentPolicy is the policy chosen in Conf.
+func currentPolicy() *Policy {
+	policy, err := PolicyByName(Conf.StatusPolicy)
+	if err != nil {
+		return Policies[DefaultPolicy]
+	}
+	return policy
+}
@@ -0,0 +1,57 @@
+package mdns_test
+
+import (
+	"testing"
+
+	"github.com/rackerlabs/mdns"
+)
+
+func TestPolicyDesignate(t *testing.T) {
+	policy, err := mdns.PolicyByName("")
+	ok(t, err)
+	equals(t, "designate", policy.Name)
+
+	// gomdns.com. in the test database is PENDING/UPDATE
+	equals(t, mdns.VerdictServe, policy.ZoneVerdict("PENDING", "UPDATE"))
+	equals(t, mdns.VerdictServe, policy.ZoneVerdict("ACTIVE", "NONE"))
+	equals(t, mdns.VerdictRefuse, policy.ZoneVerdict("ERROR", "UPDATE"))
+	equals(t, mdns.VerdictRefuse, policy.ZoneVerdict("DELETED", "NONE"))
+
+	equals(t, mdns.VerdictServe, policy.RecordVerdict("PENDING", "CREATE"))
+	equals(t, mdns.VerdictExclude, policy.RecordVerdict("PENDING", "DELETE"))
+	equals(t, mdns.VerdictExclude, policy.RecordVerdict("DELETED", "NONE"))
+}
+
+func TestPolicyActiveOnly(t *testing.T) {
+	policy, err := mdns.PolicyByName("active_only")
+	ok(t, err)
+
+	equals(t, mdns.VerdictServe, policy.ZoneVerdict("ACTIVE", "NONE"))
+	equals(t, mdns.VerdictRefuse, policy.ZoneVerdict("PENDING", "UPDATE"))
+	equals(t, mdns.VerdictServe, policy.RecordVerdict("ACTIVE", "NONE"))
+	equals(t, mdns.VerdictExclude, policy.RecordVerdict("ACTIVE", "DELETE"))
+	equals(t, mdns.VerdictExclude, policy.RecordVerdict("PENDING", "CREATE"))
+}
+
+func TestPolicyUnknown(t *testing.T) {
+	_, err := mdns.PolicyByName("lenient")
+	assert(t, err != nil, "expected an error for an unknown policy")
+}
+
+func TestPolicyRefusesZone(t *testing.T) {
+	SetUp()
+	mdns.Conf.StatusPolicy = "active_only"
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+
+	_, err := mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	equals(t, mdns.ErrZoneRefused, err)
+	_, err = mysql.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	equals(t, mdns.ErrZoneRefused, err)
+
+	serials, err := mysql.GetZoneSerials(mdns.NewRequestContext())
+	ok(t, err)
+	_, found := serials["gomdns.com."]
+	assert(t, !found, "refused zone gomdns.com. should not be polled")
+}
@@ -0,0 +1,116 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+//
+// Record Data
+//
+
+// buildRR turns a row into a dns.RR. Rows are handed to the zone file parser
+// as one line, so data that the parser would read as syntax, rather than as
+// part of the record, is refused before it gets there.
+func buildRR(rr RR, zone Zone) (dns.RR, error) {
+	if err := checkRecordText(rr.Name); err != nil {
+		return nil, fmt.Errorf("name %q: %s", rr.Name, err)
+	}
+	if err := checkRecordText(rr.Data); err != nil {
+		return nil, fmt.Errorf("data %q: %s", rr.Data, err)
+	}
+
+	ttl := zone.Ttl
+	if rr.Ttl.Valid {
+		ttl = rr.Ttl.Int64
+	}
+	record := fmt.Sprintf("%s %d IN %s %s", rr.Name, ttl, rr.Rrtype, rr.Data)
+	DnsRR, err := dns.NewRR(record)
+	if err != nil {
+		return nil, err
+	}
+	if DnsRR == nil {
+		return nil, errors.New("no record in data")
+	}
+	log.Debug(fmt.Sprintf("Processed record %s", record))
+	return DnsRR, nil
+}
+
+// checkRecordText refuses text that would change how the rest of the line is
+// parsed: a $ directive, a ; comment outside quotes, or a line break.
+func checkRecordText(text string) error {
+	if strings.HasPrefix(strings.TrimSpace(text), "$") {
+		return errors.New("starts with $")
+	}
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return errors.New("has a ; outside quotes")
+			}
+		case '\n', '\r':
+			return errors.New("has a line break")
+		}
+	}
+	return nil
+}
+
+// badRecord reports a row that couldn't be built. Unless -strict_records is
+// set the row is skipped, and nil is returned so the rest of the zone is
+// still served.
+func badRecord(rr RR, zone Zone, err error) error {
+	badRecords.WithLabelValues(rr.Rrtype).Inc()
+	if Conf.StrictRecords {
+		log.Error(fmt.Sprintf("Bad record %s (%s %s) in %s: %s", rr.Id, rr.Name, rr.Rrtype, zone.Name, err))
+		return fmt.Errorf("bad record %s: %s", rr.Id, err)
+	}
+	log.Error(fmt.Sprintf("Skipping bad record %s (%s %s) in %s: %s", rr.Id, rr.Name, rr.Rrtype, zone.Name, err))
+	return nil
+}
+
+// spfAsTxt adds a TXT copy of each SPF record in rrs with -spf_as_txt, for
+// clients that only look SPF up as TXT, unless the same TXT record is already
+// there. Only TXT and ANY queries, and AXFRs, get the copies, and the SPF
+// records themselves are left out of a TXT query.
+func spfAsTxt(rrs []dns.RR, RRType string) []dns.RR {
+	if !Conf.SpfAsTxt {
+		return rrs
+	}
+	if RRType != "TXT" && RRType != "ANY" && RRType != "AXFR" {
+		return rrs
+	}
+	served := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		spf, ok := rr.(*dns.SPF)
+		if !ok {
+			served = append(served, rr)
+			continue
+		}
+		if RRType != "TXT" {
+			served = append(served, rr)
+		}
+		txt := &dns.TXT{Hdr: spf.Hdr, Txt: spf.Txt}
+		txt.Hdr.Rrtype = dns.TypeTXT
+		if !hasDuplicate(rrs, txt) {
+			served = append(served, txt)
+		}
+	}
+	return served
+}
+
+func hasDuplicate(rrs []dns.RR, rr dns.RR) bool {
+	for _, other := range rrs {
+		if dns.IsDuplicate(other, rr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package mdns_test
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rackerlabs/mdns"
+)
+
+// recordTypes is every record in recordtypes.com., from
+// test_resources/record_types.sql, but the SOA
+var recordTypes = []struct{ name, rrtype string }{
+	{"recordtypes.com.", "NS"},
+	{"a.recordtypes.com.", "A"},
+	{"aaaa.recordtypes.com.", "AAAA"},
+	{"cname.recordtypes.com.", "CNAME"},
+	{"recordtypes.com.", "MX"},
+	{"_sip._tcp.recordtypes.com.", "SRV"},
+	{"txt.recordtypes.com.", "TXT"},
+	{"recordtypes.com.", "SPF"},
+	{"1.2.0.192.recordtypes.com.", "PTR"},
+	{"a.recordtypes.com.", "SSHFP"},
+	{"naptr.recordtypes.com.", "NAPTR"},
+	{"recordtypes.com.", "CAA"},
+	{"cert.recordtypes.com.", "CERT"},
+	{"child.recordtypes.com.", "DS"},
+	{"child.recordtypes.com.", "DNSKEY"},
+	{"_443._tcp.recordtypes.com.", "TLSA"},
+	{"c93f._smimecert.recordtypes.com.", "SMIMEA"},
+	{"c93f._openpgpkey.recordtypes.com.", "OPENPGPKEY"},
+	{"_http._tcp.recordtypes.com.", "URI"},
+	{"loc.recordtypes.com.", "LOC"},
+	{"hinfo.recordtypes.com.", "HINFO"},
+	{"recordtypes.com.", "HTTPS"},
+	{"_svc.recordtypes.com.", "SVCB"},
+	{"generic.recordtypes.com.", "TYPE65280"},
+}
+
+func TestRecordTypesAxfr(t *testing.T) {
+	SetUp()
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	rrs, err := mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "recordtypes.com.")
+	ok(t, err)
+	// Every record, and the SOA on both ends
+	equals(t, len(recordTypes)+2, len(rrs))
+
+	msg := new(dns.Msg)
+	msg.SetAxfr("recordtypes.com.")
+	msg.Answer = rrs
+	_, err = msg.Pack()
+	ok(t, err)
+}
+
+func TestRecordTypesQuery(t *testing.T) {
+	SetUp()
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	for _, record := range recordTypes {
+		rrs, err := mysql.GetQueryRRs(mdns.NewRequestContext(), record.name, record.rrtype)
+		ok(t, err)
+		assert(t, len(rrs) == 1, "%s %s: expected 1 record, got %d", record.name, record.rrtype, len(rrs))
+		equals(t, record.rrtype, dns.Type(rrs[0].Header().Rrtype).String())
+	}
+}
+
+// cannedSpfZone makes the fake driver serve spf.com. with an SPF record at
+// its apex.
+func cannedSpfZone() {
+	zone := []string{"id", "name", "ttl", "status", "action", "pool_id", "serial",
+		"email", "refresh", "retry", "expire", "minimum", "shard"}
+	row := []driver.Value{"spf", "spf.com.", int64(3600), "ACTIVE", "NONE",
+		"794ccc2cd75144feb57f8894c9f5c842", int64(1), "hostmaster.spf.com.",
+		int64(3600), int64(600), int64(86400), int64(300), int64(0)}
+	fakeDB.setRows("zones.reverse_name IN", zone, row)
+	fakeDB.setRows("zones.name = ?", zone, row)
+
+	record := []string{"id", "type", "ttl", "name", "created_at", "data", "status", "action"}
+	soa := []driver.Value{"soa", "SOA", nil, "spf.com.", "1", "ns1.spf.com. hostmaster.spf.com. 1 3600 600 86400 300", "ACTIVE", "NONE"}
+	spf := []driver.Value{"spf", "SPF", nil, "spf.com.", "2", `"v=spf1 -all"`, "ACTIVE", "NONE"}
+	fakeDB.setRows("ORDER BY recordsets.created_at", record, soa, spf)
+	fakeDB.setRows("recordsets.type IN ('TXT', 'SPF')", record, spf)
+	fakeDB.setRows("recordsets.type = 'SPF'", record, spf)
+}
+
+func TestSpfAsTxt(t *testing.T) {
+	mysql, _, _ := openFake(t, "spf")
+	defer mysql.Close()
+	cannedSpfZone()
+	defer fakeDB.clearRows()
+	ctx := mdns.NewRequestContext()
+
+	rrs, err := mysql.GetQueryRRs(ctx, "spf.com.", "TXT")
+	ok(t, err)
+	equals(t, 0, len(rrs))
+
+	mdns.Conf.SpfAsTxt = true
+	defer func() { mdns.Conf.SpfAsTxt = false }()
+
+	rrs, err = mysql.GetQueryRRs(ctx, "spf.com.", "TXT")
+	ok(t, err)
+	equals(t, 1, len(rrs))
+	equals(t, []string{"v=spf1 -all"}, rrs[0].(*dns.TXT).Txt)
+
+	// An SPF query only gets the SPF record
+	rrs, err = mysql.GetQueryRRs(ctx, "spf.com.", "SPF")
+	ok(t, err)
+	equals(t, 1, len(rrs))
+	_, isSpf := rrs[0].(*dns.SPF)
+	assert(t, isSpf, "expected the SPF record, got %s", rrs[0])
+
+	// The SOA on both ends, the SPF record and its TXT copy
+	rrs, err = mysql.GetFullAxfrRRs(ctx, "spf.com.")
+	ok(t, err)
+	equals(t, 4, len(rrs))
+	_, isTxt := rrs[2].(*dns.TXT)
+	assert(t, isTxt, "expected the TXT copy after the SPF record, got %s", rrs[2])
+}
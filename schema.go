@@ -0,0 +1,69 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+)
+
+//
+// Schema
+//
+
+// schema is the table and column names of one generation of Designate's
+// database. Designate's migration 80 renamed domains to zones, and
+// domain_id to zone_id. Queries alias the zone table as zones, so only the
+// names below change between generations. The domains table has no shard
+// column, so Sharded is false and every zone is read as shard 0. It also
+// keeps the masters of secondary zones in domain_attributes, which mdns
+// doesn't read, so it has no MasterTable, and it has no TaskTable for
+// exports either.
+type schema struct {
+	Name         string
+	ZoneTable    string
+	ZoneIdColumn string
+	MasterTable  string
+	TaskTable    string
+	Sharded      bool
+	MinVersion   int
+	MaxVersion   int
+}
+
+// The migrate_version ranges mdns knows the layout of. Anything else fails
+// at Open, rather than mdns guessing at the layout.
+var schemas = []*schema{
+	&schema{Name: "domains", ZoneTable: "domains", ZoneIdColumn: "domain_id", MasterTable: "", TaskTable: "", Sharded: false, MinVersion: 70, MaxVersion: 79},
+	&schema{Name: "zones", ZoneTable: "zones", ZoneIdColumn: "zone_id", MasterTable: "zone_masters", TaskTable: "zone_tasks", Sharded: true, MinVersion: 80, MaxVersion: 101},
+}
+
+// zoneColumns are the columns of a Zone, from the zone table aliased as zones.
+func (s *schema) zoneColumns() string {
+	shard := "0 AS shard"
+	if s.Sharded {
+		shard = "zones.shard"
+	}
+	return `zones.id, zones.name, zones.ttl, zones.status, zones.action, zones.pool_id,
+		       zones.serial, zones.email, zones.refresh, zones.retry, zones.expire, zones.minimum, ` + shard
+}
+
+func schemaForVersion(version int) (*schema, error) {
+	for _, s := range schemas {
+		if version >= s.MinVersion && version <= s.MaxVersion {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported Designate schema version %d, mdns supports %d to %d",
+		version, schemas[0].MinVersion, schemas[len(schemas)-1].MaxVersion)
+}
+
+// schemaVersion reads the version of Designate's schema from migrate_version
+// in db.
+func schemaVersion(ctx context.Context, db *sqlx.DB) (int, error) {
+	var version int
+	err := db.QueryRowxContext(ctx,
+		`SELECT version FROM migrate_version WHERE repository_id = 'Designate'`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("could not read the Designate schema version from migrate_version: %s", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,56 @@
+package mdns_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rackerlabs/mdns"
+)
+
+// openSchema opens a MySQLDriver on the fake driver, with no replicas, whose
+// primary reports the given migrate_version.
+func openSchema(name string, version int) (*mdns.MySQLDriver, error) {
+	SetUp()
+	fakeDB.setVersion(name, version)
+	mdns.Conf.DbType = "mdns_fake"
+	mdns.Conf.DbConn = name
+
+	mysql := &mdns.MySQLDriver{}
+	return mysql, mysql.Open()
+}
+
+func TestSchemaZones(t *testing.T) {
+	mysql, err := openSchema("schema-zones", 86)
+	ok(t, err)
+	defer mysql.Close()
+	equals(t, "zones", mysql.Schema())
+
+	_, err = mysql.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	query := fakeDB.lastQuery("schema-zones")
+	assert(t, strings.Contains(query, "FROM zones AS zones"), "unexpected query: %s", query)
+}
+
+func TestSchemaDomains(t *testing.T) {
+	mysql, err := openSchema("schema-domains", 75)
+	ok(t, err)
+	defer mysql.Close()
+	equals(t, "domains", mysql.Schema())
+
+	_, err = mysql.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	query := fakeDB.lastQuery("schema-domains")
+	assert(t, strings.Contains(query, "FROM domains AS zones"), "unexpected query: %s", query)
+
+	_, err = mysql.GetZoneSerials(mdns.NewRequestContext())
+	ok(t, err)
+	query = fakeDB.lastQuery("schema-domains")
+	assert(t, strings.Contains(query, "FROM domains AS zones"), "unexpected query: %s", query)
+}
+
+func TestSchemaUnknownVersion(t *testing.T) {
+	mysql, err := openSchema("schema-unknown", 200)
+	defer mysql.Close()
+	assert(t, err != nil, "expected Open to fail on schema version 200")
+	assert(t, strings.Contains(err.Error(), "unsupported Designate schema version 200"), "unexpected error: %s", err)
+}
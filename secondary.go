@@ -0,0 +1,647 @@
+package mdns
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Secondary Zones
+//
+
+var (
+	secondaryChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "secondary_soa_checks_total",
+		Help:      "SOA checks of secondary zones against their masters, by result (current, changed, failed).",
+	}, []string{"result"})
+
+	secondaryTransfers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mdns",
+		Name:      "secondary_transfers_total",
+		Help:      "Transfers of secondary zones from their masters, by type (axfr, ixfr) and result (success, failure).",
+	}, []string{"type", "result"})
+
+	secondaryZones = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mdns",
+		Name:      "secondary_zones",
+		Help:      "Secondary zones, by state (loaded, pending, expired).",
+	}, []string{"state"})
+)
+
+func init() {
+	prometheus.MustRegister(secondaryChecks, secondaryTransfers, secondaryZones)
+}
+
+// How long to wait before checking a zone again when mdns has never seen its
+// SOA, and so has no retry timer to go by
+const secondaryInitialRetry = time.Minute
+
+// errZoneUnavailable is returned for a secondary zone that hasn't been
+// transferred yet, or has expired. It is answered with SERVFAIL.
+var errZoneUnavailable = errors.New("secondary zone has not been transferred, or has expired")
+
+// SecondaryZone is a zone Designate keeps as type SECONDARY, and the
+// host:port of each of its masters.
+type SecondaryZone struct {
+	Name    string
+	Masters []string
+}
+
+// SecondaryLister lists the secondary zones mdns should transfer.
+type SecondaryLister interface {
+	GetSecondaryZones(context.Context) ([]SecondaryZone, error)
+}
+
+// GetSecondaryZones returns the secondary zones mdns serves, with the masters
+// from zone_masters. Zones the status policy refuses, and zones in shards
+// outside -shards, are left out.
+func (mysql *MySQLDriver) GetSecondaryZones(ctx context.Context) ([]SecondaryZone, error) {
+	names := mysql.names()
+	if names.MasterTable == "" {
+		return nil, fmt.Errorf("secondary zones are not supported with the %s schema", names.Name)
+	}
+	filter, args := shardFilter()
+	query := fmt.Sprintf(
+		`SELECT zones.name, zones.status, zones.action, masters.host, masters.port
+		       FROM %s AS zones
+		       INNER JOIN %s AS masters ON masters.%s = zones.id
+		       WHERE zones.type = 'SECONDARY'
+		       AND zones.pool_id = '794ccc2cd75144feb57f8894c9f5c842'
+		       AND zones.deleted = '0'%s
+		       ORDER BY zones.name, masters.host, masters.port`,
+		names.ZoneTable, names.MasterTable, names.ZoneIdColumn, filter)
+
+	var zones []SecondaryZone
+	err := mysql.read(ctx, func(db *sqlx.DB) error {
+		zones = nil
+		start := time.Now()
+		rows, err := db.QueryxContext(ctx, query, args...)
+		if err != nil {
+			observeDBQuery("secondary_zones", start, err)
+			return err
+		}
+		defer rows.Close()
+
+		policy := currentPolicy()
+		for rows.Next() {
+			var name, status, action, host string
+			var port int
+			if err := rows.Scan(&name, &status, &action, &host, &port); err != nil {
+				observeDBQuery("secondary_zones", start, err)
+				return err
+			}
+			if policy.ZoneVerdict(status, action) == VerdictRefuse {
+				continue
+			}
+			master := net.JoinHostPort(host, strconv.Itoa(port))
+			if n := len(zones); n > 0 && strings.EqualFold(zones[n-1].Name, name) {
+				zones[n-1].Masters = append(zones[n-1].Masters, master)
+			} else {
+				zones = append(zones, SecondaryZone{Name: name, Masters: []string{master}})
+			}
+		}
+		err = rows.Err()
+		observeDBQuery("secondary_zones", start, err)
+		return err
+	})
+	if err != nil {
+		LoggerFrom(ctx).Error(fmt.Sprintf("Error fetching secondary zones: %s", err))
+		return nil, err
+	}
+	return zones, nil
+}
+
+// secondaryZone is the transfer state of one secondary zone. rrs is the zone
+// in AXFR order, with the SOA at both ends, and is replaced rather than
+// modified, so it can be handed out without copying.
+type secondaryZone struct {
+	name      string
+	masters   []string
+	rrs       []dns.RR
+	serial    uint32
+	refreshed time.Time
+	due       time.Time
+	checking  bool
+}
+
+func (zone *secondaryZone) soa() *dns.SOA {
+	if len(zone.rrs) == 0 {
+		return nil
+	}
+	soa, _ := zone.rrs[0].(*dns.SOA)
+	return soa
+}
+
+// expired is whether the zone has gone longer than the SOA expire timer
+// without reaching a master, after which it must not be served.
+func (zone *secondaryZone) expired() bool {
+	soa := zone.soa()
+	return soa != nil && time.Since(zone.refreshed) > time.Duration(soa.Expire)*time.Second
+}
+
+func (zone *secondaryZone) available() bool {
+	return zone.soa() != nil && !zone.expired()
+}
+
+// SecondaryDriver wraps another driver and answers for secondary zones from
+// copies transferred from their masters. Each zone's masters are checked on
+// its SOA refresh timer, or its retry timer after a failure, and the zone is
+// transferred by IXFR or AXFR when the serial moves. Everything else is
+// passed through.
+type SecondaryDriver struct {
+	driver Driver
+	lister SecondaryLister
+
+	mutex sync.Mutex
+	zones map[string]*secondaryZone
+	stop  chan struct{}
+	kick  chan struct{}
+}
+
+func NewSecondaryDriver(driver Driver, lister SecondaryLister) *SecondaryDriver {
+	return &SecondaryDriver{
+		driver: driver,
+		lister: lister,
+		zones:  map[string]*secondaryZone{},
+		kick:   make(chan struct{}, 1),
+	}
+}
+
+func (secondary *SecondaryDriver) Open() error {
+	return secondary.driver.Open()
+}
+
+func (secondary *SecondaryDriver) Ping(ctx context.Context) error {
+	return secondary.driver.Ping(ctx)
+}
+
+func (secondary *SecondaryDriver) FindZone(ctx context.Context, qname string) (Zone, error) {
+	return secondary.driver.FindZone(ctx, qname)
+}
+
+// enclosing returns the records of the closest secondary zone enclosing
+// name, and whether there is one. A zone in the database below that one,
+// like a primary child of a secondary zone, encloses name more closely, so
+// the secondary copy isn't used for names in it.
+func (secondary *SecondaryDriver) enclosing(ctx context.Context, name string) ([]dns.RR, bool, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	secondary.mutex.Lock()
+	var found *secondaryZone
+	for _, suffix := range nameSuffixes(name) {
+		if zone, ok := secondary.zones[suffix]; ok {
+			found = zone
+			break
+		}
+	}
+	if found == nil {
+		secondary.mutex.Unlock()
+		return nil, false, nil
+	}
+	zonename, available, rrs := found.name, found.available(), found.rrs
+	secondary.mutex.Unlock()
+
+	if name != zonename {
+		closest, err := secondary.driver.FindZone(ctx, name)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, true, err
+		}
+		if err == nil && dns.CountLabel(closest.Name) > dns.CountLabel(zonename) {
+			return nil, false, nil
+		}
+	}
+	if !available {
+		return nil, true, errZoneUnavailable
+	}
+	return rrs, true, nil
+}
+
+func (secondary *SecondaryDriver) GetFullAxfrRRs(ctx context.Context, zonename string) ([]dns.RR, error) {
+	secondary.mutex.Lock()
+	zone, ok := secondary.zones[strings.ToLower(dns.Fqdn(zonename))]
+	if !ok {
+		secondary.mutex.Unlock()
+		return secondary.driver.GetFullAxfrRRs(ctx, zonename)
+	}
+	available, rrs := zone.available(), zone.rrs
+	secondary.mutex.Unlock()
+
+	if !available {
+		LoggerFrom(ctx).Warn(fmt.Sprintf("Can't answer AXFR for %s: %s", zonename, errZoneUnavailable))
+		return nil, errZoneUnavailable
+	}
+	return rrs, nil
+}
+
+func (secondary *SecondaryDriver) GetQueryRRs(ctx context.Context, RRName string, RRType string) ([]dns.RR, error) {
+	rrs, ok, err := secondary.enclosing(ctx, RRName)
+	if !ok {
+		return secondary.driver.GetQueryRRs(ctx, RRName, RRType)
+	}
+	if err != nil {
+		LoggerFrom(ctx).Warn(fmt.Sprintf("Can't answer %s query for %s: %s", RRType, RRName, err))
+		return nil, err
+	}
+
+	return axfrAnswers(rrs, RRName, RRType), nil
+}
+
+// GetZoneSerials reports the serial transferred for each secondary zone,
+// rather than the one in the database, so a cache in front of this driver
+// notices new transfers. Secondary zones that can't be served are left out.
+func (secondary *SecondaryDriver) GetZoneSerials(ctx context.Context) (map[string]uint32, error) {
+	serials, err := secondary.driver.GetZoneSerials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	secondary.mutex.Lock()
+	defer secondary.mutex.Unlock()
+	for name, zone := range secondary.zones {
+		if zone.available() {
+			serials[name] = zone.serial
+		} else {
+			delete(serials, name)
+		}
+	}
+	return serials, nil
+}
+
+// Notify makes a secondary zone due for a check against its masters, for
+// when a master sends a NOTIFY.
+func (secondary *SecondaryDriver) Notify(zonename string) {
+	secondary.mutex.Lock()
+	zone, ok := secondary.zones[strings.ToLower(dns.Fqdn(zonename))]
+	if ok {
+		zone.due = time.Time{}
+	}
+	secondary.mutex.Unlock()
+
+	if ok {
+		select {
+		case secondary.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Masters returns the masters of a secondary zone, or nil if zonename isn't
+// one.
+func (secondary *SecondaryDriver) Masters(zonename string) []string {
+	secondary.mutex.Lock()
+	defer secondary.mutex.Unlock()
+	if zone, ok := secondary.zones[strings.ToLower(dns.Fqdn(zonename))]; ok {
+		return zone.masters
+	}
+	return nil
+}
+
+// Sync reloads the list of secondary zones, then checks every zone that is
+// due against its masters, waiting for the checks to finish.
+func (secondary *SecondaryDriver) Sync(ctx context.Context) error {
+	listed, err := secondary.lister.GetSecondaryZones(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	due := []*secondaryZone{}
+	secondary.mutex.Lock()
+	current := map[string]*secondaryZone{}
+	for _, listing := range listed {
+		name := strings.ToLower(dns.Fqdn(listing.Name))
+		zone, ok := secondary.zones[name]
+		if !ok {
+			zone = &secondaryZone{name: name}
+			log.Info(fmt.Sprintf("Secondary zone %s added, masters %s", name, strings.Join(listing.Masters, ", ")))
+		}
+		zone.masters = listing.Masters
+		current[name] = zone
+		if !zone.checking && !now.Before(zone.due) {
+			zone.checking = true
+			due = append(due, zone)
+		}
+	}
+	for name := range secondary.zones {
+		if _, ok := current[name]; !ok {
+			log.Info(fmt.Sprintf("Secondary zone %s removed", name))
+		}
+	}
+	secondary.zones = current
+	secondary.mutex.Unlock()
+
+	// At most -secondary_concurrency zones are checked at once, so a first
+	// start with many zones doesn't open a socket to the masters for each
+	limit := Conf.SecondaryWorkers
+	if limit < 1 {
+		limit = 1
+	}
+	slots := make(chan struct{}, limit)
+	wait := sync.WaitGroup{}
+	for _, zone := range due {
+		wait.Add(1)
+		slots <- struct{}{}
+		go func(zone *secondaryZone) {
+			defer wait.Done()
+			defer func() { <-slots }()
+			secondary.refresh(ctx, zone)
+		}(zone)
+	}
+	wait.Wait()
+	secondary.updateGauges()
+	return nil
+}
+
+// refresh checks the masters of zone in turn, until one of them answers,
+// transferring the zone from it if its serial has moved on.
+func (secondary *SecondaryDriver) refresh(ctx context.Context, zone *secondaryZone) {
+	secondary.mutex.Lock()
+	name, masters, rrs, serial := zone.name, zone.masters, zone.rrs, zone.serial
+	secondary.mutex.Unlock()
+	loaded := len(rrs) > 0
+
+	var soa *dns.SOA
+	err := errors.New("zone has no masters")
+	for _, master := range masters {
+		soa, err = querySOA(ctx, name, master)
+		if err != nil {
+			log.Warn(fmt.Sprintf("SOA check of secondary zone %s against %s failed: %s", name, master, err))
+			continue
+		}
+		if loaded && !serialNewer(soa.Serial, serial) {
+			secondaryChecks.WithLabelValues("current").Inc()
+			log.Debug(fmt.Sprintf("Secondary zone %s is current at serial %d", name, serial))
+			break
+		}
+		secondaryChecks.WithLabelValues("changed").Inc()
+
+		var transferred []dns.RR
+		transferred, err = transferZone(ctx, name, master, rrs)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Transfer of secondary zone %s from %s failed: %s", name, master, err))
+			continue
+		}
+		rrs = transferred
+		soa = rrs[0].(*dns.SOA)
+		log.Info(fmt.Sprintf("Transferred secondary zone %s from %s, serial %d -> %d, %d records",
+			name, master, serial, soa.Serial, len(rrs)-1))
+		break
+	}
+	if soa == nil {
+		secondaryChecks.WithLabelValues("failed").Inc()
+	}
+
+	secondary.mutex.Lock()
+	defer secondary.mutex.Unlock()
+	zone.checking = false
+	if err != nil {
+		// Retry on the timer of the copy held, or failing that the one
+		// the master answered with.
+		retry := secondaryInitialRetry
+		if held := zone.soa(); held != nil {
+			retry = time.Duration(held.Retry) * time.Second
+		} else if soa != nil {
+			retry = time.Duration(soa.Retry) * time.Second
+		}
+		zone.due = time.Now().Add(retry)
+		if zone.expired() {
+			log.Error(fmt.Sprintf("Secondary zone %s has expired, no master has answered since %s", name, zone.refreshed))
+		}
+		return
+	}
+	zone.rrs = rrs
+	zone.serial = rrs[0].(*dns.SOA).Serial
+	zone.refreshed = time.Now()
+	zone.due = zone.refreshed.Add(time.Duration(rrs[0].(*dns.SOA).Refresh) * time.Second)
+}
+
+func (secondary *SecondaryDriver) updateGauges() {
+	counts := map[string]int{"loaded": 0, "pending": 0, "expired": 0}
+	secondary.mutex.Lock()
+	for _, zone := range secondary.zones {
+		switch {
+		case zone.soa() == nil:
+			counts["pending"]++
+		case zone.expired():
+			counts["expired"]++
+		default:
+			counts["loaded"]++
+		}
+	}
+	secondary.mutex.Unlock()
+	for state, count := range counts {
+		secondaryZones.WithLabelValues(state).Set(float64(count))
+	}
+}
+
+// Start syncs every interval, or as soon as a NOTIFY comes in, until Stop is
+// called.
+func (secondary *SecondaryDriver) Start(interval time.Duration) {
+	secondary.mutex.Lock()
+	if secondary.stop == nil {
+		secondary.stop = make(chan struct{})
+	}
+	stop := secondary.stop
+	secondary.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ctx := WithLogger(context.Background(), log.WithField("poller", "secondary"))
+			if err := secondary.Sync(ctx); err != nil {
+				log.Error(fmt.Sprintf("Error syncing secondary zones: %s", err))
+			}
+			select {
+			case <-ticker.C:
+			case <-secondary.kick:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends syncing.
+func (secondary *SecondaryDriver) Stop() {
+	secondary.mutex.Lock()
+	defer secondary.mutex.Unlock()
+	if secondary.stop != nil {
+		close(secondary.stop)
+		secondary.stop = nil
+	}
+}
+
+// serialNewer compares serials with RFC 1982 serial number arithmetic.
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// transferTimeout bounds each SOA check and transfer.
+func transferTimeout() time.Duration {
+	if Conf.AxfrTimeout > 0 {
+		return Conf.AxfrTimeout
+	}
+	return time.Minute
+}
+
+// querySOA asks master for the SOA of zonename, over TCP like the transfer
+// that may follow.
+func querySOA(ctx context.Context, zonename string, master string) (*dns.SOA, error) {
+	client := &dns.Client{Net: "tcp", Timeout: transferTimeout()}
+	query := new(dns.Msg)
+	query.SetQuestion(zonename, dns.TypeSOA)
+	reply, _, err := client.ExchangeContext(ctx, query, master)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("answered %s", dns.RcodeToString[reply.Rcode])
+	}
+	for _, rr := range reply.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+	return nil, errors.New("answer has no SOA")
+}
+
+// transferZone brings held, the copy of zonename in AXFR order, up to date
+// from master. An IXFR is tried first when there is a copy to apply it to,
+// falling back to an AXFR.
+func transferZone(ctx context.Context, zonename string, master string, held []dns.RR) ([]dns.RR, error) {
+	if len(held) > 0 {
+		soa := held[0].(*dns.SOA)
+		request := new(dns.Msg)
+		request.SetIxfr(zonename, soa.Serial, soa.Ns, soa.Mbox)
+		rrs, err := receive(ctx, request, master)
+		if err == nil {
+			rrs, err = applyIxfr(zonename, held, rrs)
+		}
+		if err == nil {
+			secondaryTransfers.WithLabelValues("ixfr", "success").Inc()
+			return rrs, nil
+		}
+		secondaryTransfers.WithLabelValues("ixfr", "failure").Inc()
+		log.Info(fmt.Sprintf("IXFR of %s from %s failed, trying AXFR: %s", zonename, master, err))
+	}
+
+	request := new(dns.Msg)
+	request.SetAxfr(zonename)
+	rrs, err := receive(ctx, request, master)
+	if err == nil {
+		err = checkAxfr(zonename, rrs)
+	}
+	if err == nil {
+		_, err = axfrOrder(rrs[:len(rrs)-1])
+	}
+	if err != nil {
+		secondaryTransfers.WithLabelValues("axfr", "failure").Inc()
+		return nil, err
+	}
+	secondaryTransfers.WithLabelValues("axfr", "success").Inc()
+	return rrs, nil
+}
+
+// receive runs one zone transfer, collecting every record sent.
+func receive(ctx context.Context, request *dns.Msg, master string) ([]dns.RR, error) {
+	timeout := transferTimeout()
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	transfer := &dns.Transfer{DialTimeout: timeout, ReadTimeout: timeout, WriteTimeout: timeout}
+	envelopes, err := transfer.In(request, master)
+	if err != nil {
+		return nil, err
+	}
+	rrs := []dns.RR{}
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			err = envelope.Error
+			continue
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	return rrs, err
+}
+
+// checkAxfr makes sure rrs is a whole zone, with the same SOA at both ends,
+// and that the master only sent records for zonename. The SOAs between the
+// differences of an IXFR have to be zonename's too.
+func checkAxfr(zonename string, rrs []dns.RR) error {
+	if len(rrs) < 2 {
+		return errors.New("transfer is too short")
+	}
+	first, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return errors.New("transfer does not start with an SOA")
+	}
+	last, ok := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok || last.Serial != first.Serial {
+		return errors.New("transfer does not end with the SOA it started with")
+	}
+	for _, rr := range rrs {
+		name := rr.Header().Name
+		if !dns.IsSubDomain(zonename, name) {
+			return fmt.Errorf("%s is outside the zone %s", name, zonename)
+		}
+		if _, ok := rr.(*dns.SOA); ok && !strings.EqualFold(name, zonename) {
+			return fmt.Errorf("SOA for %s in a transfer of %s", name, zonename)
+		}
+	}
+	return nil
+}
+
+// applyIxfr applies an IXFR response (RFC 1995) to held. A response that is
+// a whole zone, as a master sends when it has no history to go on, replaces
+// held instead.
+func applyIxfr(zonename string, held []dns.RR, rrs []dns.RR) ([]dns.RR, error) {
+	if err := checkAxfr(zonename, rrs); err != nil {
+		return nil, err
+	}
+	if _, ok := rrs[1].(*dns.SOA); !ok {
+		if _, err := axfrOrder(rrs[:len(rrs)-1]); err != nil {
+			return nil, err
+		}
+		return rrs, nil
+	}
+	if from := rrs[1].(*dns.SOA).Serial; from != held[0].(*dns.SOA).Serial {
+		return nil, fmt.Errorf("IXFR starts from serial %d, not %d", from, held[0].(*dns.SOA).Serial)
+	}
+
+	body := append([]dns.RR{}, held[1:len(held)-1]...)
+	// Each difference is the old SOA, the records removed, the new SOA and
+	// the records added.
+	deleting := false
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			deleting = !deleting
+			continue
+		}
+		if !deleting {
+			body = append(body, rr)
+			continue
+		}
+		for i, existing := range body {
+			if dns.IsDuplicate(existing, rr) {
+				body = append(body[:i], body[i+1:]...)
+				break
+			}
+		}
+	}
+
+	soa := rrs[0]
+	return append(append([]dns.RR{soa}, body...), soa), nil
+}
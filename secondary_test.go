@@ -0,0 +1,391 @@
+package mdns_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rackerlabs/mdns"
+)
+
+// fakeMaster is a master server for one zone, answering SOA queries, AXFRs
+// and, if ixfr is set, IXFRs from the last serial.
+type fakeMaster struct {
+	mutex    sync.Mutex
+	zone     string
+	serial   uint32
+	records  []dns.RR
+	previous []dns.RR
+	ixfr     bool
+	requests map[uint16]int
+	server   *dns.Server
+	// busy, if set, tracks requests in flight across masters, each held
+	// for delay
+	busy  *inFlight
+	delay time.Duration
+}
+
+type inFlight struct {
+	mutex sync.Mutex
+	now   int
+	most  int
+}
+
+func (busy *inFlight) start() {
+	busy.mutex.Lock()
+	busy.now++
+	if busy.now > busy.most {
+		busy.most = busy.now
+	}
+	busy.mutex.Unlock()
+}
+
+func (busy *inFlight) done() {
+	busy.mutex.Lock()
+	busy.now--
+	busy.mutex.Unlock()
+}
+
+func startMaster(t *testing.T, zone string, records ...string) *fakeMaster {
+	master := &fakeMaster{zone: zone, serial: 1, requests: map[uint16]int{}}
+	master.records = parseRRs(t, records)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ok(t, err)
+	started := make(chan struct{})
+	master.server = &dns.Server{Listener: listener, Handler: master, NotifyStartedFunc: func() { close(started) }}
+	go master.server.ActivateAndServe()
+	<-started
+	return master
+}
+
+func parseRRs(t *testing.T, records []string) []dns.RR {
+	rrs := []dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		ok(t, err)
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func (master *fakeMaster) Addr() string {
+	return master.server.Listener.Addr().String()
+}
+
+func (master *fakeMaster) Close() {
+	master.server.Shutdown()
+}
+
+// update replaces the zone's records and bumps its serial, keeping the old
+// records to send an IXFR from.
+func (master *fakeMaster) update(t *testing.T, records ...string) {
+	master.mutex.Lock()
+	defer master.mutex.Unlock()
+	master.previous = master.records
+	master.records = parseRRs(t, records)
+	master.serial++
+}
+
+func (master *fakeMaster) requested(qtype uint16) int {
+	master.mutex.Lock()
+	defer master.mutex.Unlock()
+	return master.requests[qtype]
+}
+
+func (master *fakeMaster) soa(serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: master.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      "ns1." + master.zone,
+		Mbox:    "hostmaster." + master.zone,
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  300,
+	}
+}
+
+func (master *fakeMaster) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
+	if master.busy != nil {
+		master.busy.start()
+		defer master.busy.done()
+		time.Sleep(master.delay)
+	}
+	master.mutex.Lock()
+	defer master.mutex.Unlock()
+
+	qtype := request.Question[0].Qtype
+	master.requests[qtype]++
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	soa := master.soa(master.serial)
+
+	switch qtype {
+	case dns.TypeSOA:
+		reply.Answer = []dns.RR{soa}
+	case dns.TypeAXFR:
+		reply.Answer = append(append([]dns.RR{soa}, master.records...), soa)
+	case dns.TypeIXFR:
+		if !master.ixfr {
+			reply.SetRcode(request, dns.RcodeNotImplemented)
+			break
+		}
+		// Everything from the previous serial is removed and re-added,
+		// which is a valid if wasteful difference.
+		reply.Answer = append([]dns.RR{soa, master.soa(master.serial - 1)}, master.previous...)
+		reply.Answer = append(append(append(reply.Answer, soa), master.records...), soa)
+	default:
+		reply.SetRcode(request, dns.RcodeRefused)
+	}
+	w.WriteMsg(reply)
+}
+
+type fakeLister struct {
+	mutex sync.Mutex
+	zones []mdns.SecondaryZone
+}
+
+func (lister *fakeLister) set(zones ...mdns.SecondaryZone) {
+	lister.mutex.Lock()
+	lister.zones = zones
+	lister.mutex.Unlock()
+}
+
+func (lister *fakeLister) GetSecondaryZones(ctx context.Context) ([]mdns.SecondaryZone, error) {
+	lister.mutex.Lock()
+	defer lister.mutex.Unlock()
+	return lister.zones, nil
+}
+
+// openSecondary returns a SecondaryDriver in front of the fake database,
+// with secondary zones listed by lister.
+func openSecondary(t *testing.T, name string, lister *fakeLister) *mdns.SecondaryDriver {
+	SetUp()
+	mdns.Conf.DbType = "mdns_fake"
+	mdns.Conf.DbConn = name
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	return mdns.NewSecondaryDriver(mysql, lister)
+}
+
+func queryA(t *testing.T, driver mdns.Driver, name string) []string {
+	rrs, err := driver.GetQueryRRs(mdns.NewRequestContext(), name, "A")
+	ok(t, err)
+	addresses := []string{}
+	for _, rr := range rrs {
+		addresses = append(addresses, rr.(*dns.A).A.String())
+	}
+	return addresses
+}
+
+func TestSecondaryTransfersZone(t *testing.T) {
+	master := startMaster(t, "example.com.", "www.example.com. 300 IN A 192.0.2.1")
+	defer master.Close()
+	master.ixfr = true
+	lister := &fakeLister{}
+	lister.set(mdns.SecondaryZone{Name: "example.com.", Masters: []string{master.Addr()}})
+	secondary := openSecondary(t, "secondary-transfer", lister)
+
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, 1, master.requested(dns.TypeAXFR))
+	equals(t, []string{"192.0.2.1"}, queryA(t, secondary, "www.example.com."))
+	rrs, err := secondary.GetFullAxfrRRs(mdns.NewRequestContext(), "example.com.")
+	ok(t, err)
+	equals(t, 3, len(rrs))
+
+	// Nothing is checked again until the refresh timer is up, or a NOTIFY
+	// comes in.
+	master.update(t, "www.example.com. 300 IN A 192.0.2.2")
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, []string{"192.0.2.1"}, queryA(t, secondary, "www.example.com."))
+
+	secondary.Notify("example.com.")
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, 1, master.requested(dns.TypeIXFR))
+	equals(t, 1, master.requested(dns.TypeAXFR))
+	equals(t, []string{"192.0.2.2"}, queryA(t, secondary, "www.example.com."))
+
+	serials, err := secondary.GetZoneSerials(mdns.NewRequestContext())
+	ok(t, err)
+	equals(t, uint32(2), serials["example.com."])
+}
+
+func TestSecondaryFallsBackToAxfr(t *testing.T) {
+	master := startMaster(t, "example.net.", "www.example.net. 300 IN A 192.0.2.1")
+	defer master.Close()
+	lister := &fakeLister{}
+	lister.set(mdns.SecondaryZone{Name: "example.net.", Masters: []string{master.Addr()}})
+	secondary := openSecondary(t, "secondary-axfr", lister)
+	ok(t, secondary.Sync(context.Background()))
+
+	master.update(t, "www.example.net. 300 IN A 192.0.2.2", "mail.example.net. 300 IN A 192.0.2.3")
+	secondary.Notify("example.net.")
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, 1, master.requested(dns.TypeIXFR))
+	equals(t, 2, master.requested(dns.TypeAXFR))
+	equals(t, []string{"192.0.2.2"}, queryA(t, secondary, "www.example.net."))
+	equals(t, []string{"192.0.2.3"}, queryA(t, secondary, "mail.example.net."))
+}
+
+func TestSecondaryRejectsOutOfZoneRecords(t *testing.T) {
+	master := startMaster(t, "example.biz.", "www.example.biz. 300 IN A 192.0.2.1", "www.example.com. 300 IN A 192.0.2.66")
+	defer master.Close()
+	lister := &fakeLister{}
+	lister.set(mdns.SecondaryZone{Name: "example.biz.", Masters: []string{master.Addr()}})
+	secondary := openSecondary(t, "secondary-outside", lister)
+
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, 1, master.requested(dns.TypeAXFR))
+	_, err := secondary.GetFullAxfrRRs(mdns.NewRequestContext(), "example.biz.")
+	assert(t, err != nil, "expected a transfer with records outside the zone to be rejected")
+	equals(t, []string{}, queryA(t, secondary, "www.example.com."))
+
+	// A good copy isn't replaced by an IXFR, or AXFR, that strays outside it
+	master.ixfr = true
+	master.update(t, "www.example.biz. 300 IN A 192.0.2.1")
+	secondary.Notify("example.biz.")
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, []string{"192.0.2.1"}, queryA(t, secondary, "www.example.biz."))
+
+	master.update(t, "www.example.biz. 300 IN A 192.0.2.2", "www.example.com. 300 IN A 192.0.2.66")
+	secondary.Notify("example.biz.")
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, 1, master.requested(dns.TypeIXFR))
+	equals(t, 3, master.requested(dns.TypeAXFR))
+	equals(t, []string{"192.0.2.1"}, queryA(t, secondary, "www.example.biz."))
+	equals(t, []string{}, queryA(t, secondary, "www.example.com."))
+}
+
+func TestSecondaryRejectsOtherZone(t *testing.T) {
+	master := startMaster(t, "sub.example.biz.", "www.sub.example.biz. 300 IN A 192.0.2.1")
+	defer master.Close()
+	lister := &fakeLister{}
+	lister.set(mdns.SecondaryZone{Name: "example.biz.", Masters: []string{master.Addr()}})
+	secondary := openSecondary(t, "secondary-other", lister)
+
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, 1, master.requested(dns.TypeAXFR))
+	_, err := secondary.GetFullAxfrRRs(mdns.NewRequestContext(), "example.biz.")
+	assert(t, err != nil, "expected a transfer of another zone to be rejected")
+}
+
+func TestSecondaryNotifyFromMaster(t *testing.T) {
+	master := startMaster(t, "example.com.", "www.example.com. 300 IN A 192.0.2.1")
+	defer master.Close()
+	lister := &fakeLister{}
+	lister.set(mdns.SecondaryZone{Name: "example.com.", Masters: []string{master.Addr()}})
+	secondary := openSecondary(t, "secondary-notify", lister)
+	ok(t, secondary.Sync(context.Background()))
+
+	zone := []string{"id", "name", "ttl", "status", "action", "pool_id", "serial",
+		"email", "refresh", "retry", "expire", "minimum", "shard"}
+	fakeDB.setRows("zones.reverse_name IN", zone, []driver.Value{"secondary", "example.com.", int64(3600),
+		"ACTIVE", "NONE", "794ccc2cd75144feb57f8894c9f5c842", int64(1), "hostmaster.example.com.",
+		int64(3600), int64(600), int64(86400), int64(300), int64(0)})
+	defer fakeDB.clearRows()
+
+	// 127.0.0.1 is only allowed as the zone's master
+	nets, err := mdns.ParseNotifyAllow("192.0.2.0/24")
+	ok(t, err)
+	mdns.Conf.NotifyAllow = nets
+	addr, stop := startServer(t, mdns.Storage{Driver: secondary})
+	defer stop()
+
+	msg := generateMsg("example.com.", dns.TypeSOA, dns.OpcodeNotify)
+	equals(t, dns.RcodeSuccess, exchange(t, addr, msg).Rcode)
+
+	lister.set(mdns.SecondaryZone{Name: "example.com.", Masters: []string{"127.0.0.2:1"}})
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, dns.RcodeRefused, exchange(t, addr, msg).Rcode)
+}
+
+func TestSecondaryConcurrency(t *testing.T) {
+	busy := &inFlight{}
+	lister := &fakeLister{}
+	zones := []mdns.SecondaryZone{}
+	for i := 0; i < 8; i++ {
+		zone := fmt.Sprintf("zone%d.example.", i)
+		master := startMaster(t, zone, "www."+zone+" 300 IN A 192.0.2.1")
+		defer master.Close()
+		master.busy, master.delay = busy, 20*time.Millisecond
+		zones = append(zones, mdns.SecondaryZone{Name: zone, Masters: []string{master.Addr()}})
+	}
+	lister.set(zones...)
+	secondary := openSecondary(t, "secondary-concurrency", lister)
+	mdns.Conf.SecondaryWorkers = 3
+
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, 3, busy.most)
+	for _, zone := range zones {
+		equals(t, []string{"192.0.2.1"}, queryA(t, secondary, "www."+zone.Name))
+	}
+}
+
+func TestSecondaryPrimaryChild(t *testing.T) {
+	master := startMaster(t, "example.com.",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"sub.example.com. 300 IN NS ns1.sub.example.com.",
+		"www.sub.example.com. 300 IN A 192.0.2.66")
+	defer master.Close()
+	lister := &fakeLister{}
+	lister.set(mdns.SecondaryZone{Name: "example.com.", Masters: []string{master.Addr()}})
+	secondary := openSecondary(t, "secondary-child", lister)
+	ok(t, secondary.Sync(context.Background()))
+
+	// sub.example.com. is a primary zone in the database
+	zone := []string{"id", "name", "ttl", "status", "action", "pool_id", "serial",
+		"email", "refresh", "retry", "expire", "minimum", "shard"}
+	fakeDB.setRows("zones.reverse_name IN", zone, []driver.Value{"child", "sub.example.com.", int64(3600),
+		"ACTIVE", "NONE", "794ccc2cd75144feb57f8894c9f5c842", int64(1), "hostmaster.sub.example.com.",
+		int64(3600), int64(600), int64(86400), int64(300), int64(0)})
+	fakeDB.setRows("recordsets.type = 'A'", []string{"id", "type", "ttl", "name", "created_at", "data", "status", "action"},
+		[]driver.Value{"www", "A", nil, "www.sub.example.com.", "1", "192.0.2.2", "ACTIVE", "NONE"})
+	defer fakeDB.clearRows()
+
+	equals(t, []string{"192.0.2.2"}, queryA(t, secondary, "www.sub.example.com."))
+	fakeDB.clearRows()
+	equals(t, []string{"192.0.2.1"}, queryA(t, secondary, "www.example.com."))
+}
+
+func TestSecondaryTriesNextMaster(t *testing.T) {
+	down := startMaster(t, "example.org.")
+	downAddr := down.Addr()
+	down.Close()
+	master := startMaster(t, "example.org.", "www.example.org. 300 IN A 192.0.2.1")
+	defer master.Close()
+	lister := &fakeLister{}
+	lister.set(mdns.SecondaryZone{Name: "example.org.", Masters: []string{downAddr, master.Addr()}})
+	secondary := openSecondary(t, "secondary-masters", lister)
+
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, []string{"192.0.2.1"}, queryA(t, secondary, "www.example.org."))
+}
+
+func TestSecondaryUnavailable(t *testing.T) {
+	down := startMaster(t, "example.info.")
+	downAddr := down.Addr()
+	down.Close()
+	lister := &fakeLister{}
+	lister.set(mdns.SecondaryZone{Name: "example.info.", Masters: []string{downAddr}})
+	secondary := openSecondary(t, "secondary-down", lister)
+	ok(t, secondary.Sync(context.Background()))
+
+	_, err := secondary.GetQueryRRs(mdns.NewRequestContext(), "www.example.info.", "A")
+	assert(t, err != nil, "expected an error for a secondary zone that was never transferred")
+	_, err = secondary.GetFullAxfrRRs(mdns.NewRequestContext(), "example.info.")
+	assert(t, err != nil, "expected an error for a secondary zone that was never transferred")
+
+	// Other zones still come from the database
+	equals(t, []string{}, queryA(t, secondary, "www.example.com."))
+
+	lister.set()
+	ok(t, secondary.Sync(context.Background()))
+	equals(t, []string{}, queryA(t, secondary, "www.example.info."))
+}
@@ -0,0 +1,91 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//
+// Shards
+//
+
+// Designate puts every zone in one of 4096 shards, from the first three hex
+// digits of its id.
+const (
+	MinShard = 0
+	MaxShard = 4095
+)
+
+// ShardRange is the inclusive range of zone shards an mdns instance serves.
+type ShardRange struct {
+	Min int
+	Max int
+}
+
+func (shards ShardRange) Contains(shard int) bool {
+	return shard >= shards.Min && shard <= shards.Max
+}
+
+func (shards ShardRange) String() string {
+	return fmt.Sprintf("%d-%d", shards.Min, shards.Max)
+}
+
+// ParseShardRange parses a range of the form min-max, or a single shard. An
+// empty string is every shard, returned as nil.
+func ParseShardRange(s string) (*ShardRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	bounds := []int{}
+	for _, part := range parts {
+		shard, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("shard range %q is not of the form min-max", s)
+		}
+		if shard < MinShard || shard > MaxShard {
+			return nil, fmt.Errorf("shard range %q is outside %d-%d", s, MinShard, MaxShard)
+		}
+		bounds = append(bounds, shard)
+	}
+	if bounds[0] > bounds[1] {
+		return nil, fmt.Errorf("shard range %q starts after it ends", s)
+	}
+	return &ShardRange{Min: bounds[0], Max: bounds[1]}, nil
+}
+
+// ownsShard reports whether this instance serves zones in shard. Without
+// -shards every shard is served.
+func ownsShard(shard int) bool {
+	return Conf.Shards == nil || Conf.Shards.Contains(shard)
+}
+
+// shardFilter is the condition, and its arguments, that limits a query on
+// the zone table to the shards this instance serves.
+func shardFilter() (string, []interface{}) {
+	if Conf.Shards == nil {
+		return "", nil
+	}
+	return "\n\t\tAND zones.shard BETWEEN ? AND ?", []interface{}{Conf.Shards.Min, Conf.Shards.Max}
+}
+
+// checkZone returns ErrZoneRefused for a zone this instance won't serve,
+// either because it is in a shard another instance serves, or because the
+// status policy refuses it. what describes the request, for the log.
+func checkZone(ctx context.Context, zone Zone, what string) error {
+	if !ownsShard(zone.Shard) {
+		LoggerFrom(ctx).Info(fmt.Sprintf("Refusing %s, zone %s is in shard %d, outside %s", what, zone.Name, zone.Shard, Conf.Shards))
+		return ErrZoneRefused
+	}
+	if currentPolicy().ZoneVerdict(zone.Status, zone.Action) == VerdictRefuse {
+		LoggerFrom(ctx).Info(fmt.Sprintf("Refusing %s, zone %s is %s/%s", what, zone.Name, zone.Status, zone.Action))
+		return ErrZoneRefused
+	}
+	return nil
+}
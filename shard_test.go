@@ -0,0 +1,82 @@
+package mdns_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rackerlabs/mdns"
+)
+
+func TestParseShardRange(t *testing.T) {
+	shards, err := mdns.ParseShardRange("0-2047")
+	ok(t, err)
+	equals(t, &mdns.ShardRange{Min: 0, Max: 2047}, shards)
+	assert(t, shards.Contains(2047), "2047 should be in 0-2047")
+	assert(t, !shards.Contains(2048), "2048 should not be in 0-2047")
+
+	shards, err = mdns.ParseShardRange("240")
+	ok(t, err)
+	equals(t, &mdns.ShardRange{Min: 240, Max: 240}, shards)
+
+	shards, err = mdns.ParseShardRange("")
+	ok(t, err)
+	assert(t, shards == nil, "an empty range should be every shard")
+
+	for _, bad := range []string{"a-b", "0-", "-1", "0-4096", "2048-0", "0-1-2"} {
+		_, err := mdns.ParseShardRange(bad)
+		assert(t, err != nil, "expected an error parsing %q", bad)
+	}
+}
+
+func TestShardsPollOwnedZones(t *testing.T) {
+	SetUp()
+	mdns.Conf.DbType = "mdns_fake"
+	mdns.Conf.DbConn = "shards-zones"
+	mdns.Conf.Shards = &mdns.ShardRange{Min: 0, Max: 2047}
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	defer mysql.Close()
+
+	_, err := mysql.GetZoneSerials(mdns.NewRequestContext())
+	ok(t, err)
+	query := fakeDB.lastQuery("shards-zones")
+	assert(t, strings.Contains(query, "zones.shard BETWEEN ? AND ?"), "unexpected query: %s", query)
+}
+
+func TestShardsNeedShardedSchema(t *testing.T) {
+	SetUp()
+	fakeDB.setVersion("shards-domains", 75)
+	mdns.Conf.DbType = "mdns_fake"
+	mdns.Conf.DbConn = "shards-domains"
+	mdns.Conf.Shards = &mdns.ShardRange{Min: 0, Max: 2047}
+
+	mysql := &mdns.MySQLDriver{}
+	err := mysql.Open()
+	defer mysql.Close()
+	assert(t, err != nil, "expected Open to fail with -shards on the domains schema")
+}
+
+func TestShardsRefuseZone(t *testing.T) {
+	SetUp()
+	// gomdns.com. in the test database is in shard 240
+	mdns.Conf.Shards = &mdns.ShardRange{Min: 2048, Max: 4095}
+
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+
+	_, err := mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	equals(t, mdns.ErrZoneRefused, err)
+	_, err = mysql.GetQueryRRs(mdns.NewRequestContext(), "www.gomdns.com.", "A")
+	equals(t, mdns.ErrZoneRefused, err)
+
+	serials, err := mysql.GetZoneSerials(mdns.NewRequestContext())
+	ok(t, err)
+	_, found := serials["gomdns.com."]
+	assert(t, !found, "gomdns.com. is outside the shards and should not be polled")
+
+	mdns.Conf.Shards = &mdns.ShardRange{Min: 0, Max: 2047}
+	rrs, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	equals(t, 1, len(rrs))
+}
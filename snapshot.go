@@ -0,0 +1,176 @@
+package mdns
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//
+// Snapshots
+//
+
+const snapshotVersion = 1
+
+// snapshot is the on-disk form of the zones in the cache. Records are kept
+// in presentation format, gob encoded and gzipped. Known lists every zone
+// the driver had at the last serial poll, cached or not.
+type snapshot struct {
+	Version int
+	Written time.Time
+	Zones   []snapshotZone
+	Known   []string
+}
+
+type snapshotZone struct {
+	Name    string
+	Serial  uint32
+	Records []string
+}
+
+// WriteSnapshot saves every current zone in the cache to path. The file is
+// replaced atomically, so a crash mid-write leaves the previous snapshot.
+func (cache *CachingDriver) WriteSnapshot(path string) (int, error) {
+	snap := snapshot{Version: snapshotVersion, Written: time.Now()}
+
+	cache.mutex.Lock()
+	for _, element := range cache.entries {
+		entry := element.Value.(*cacheEntry)
+		if entry.kind != "axfr" || entry.invalid {
+			continue
+		}
+		zone := snapshotZone{Name: entry.name, Serial: entry.serial, Records: make([]string, len(entry.rrs))}
+		for i, rr := range entry.rrs {
+			zone.Records[i] = rr.String()
+		}
+		snap.Zones = append(snap.Zones, zone)
+	}
+	for zonename := range cache.serials {
+		snap.Known = append(snap.Known, zonename)
+	}
+	cache.mutex.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := gzip.NewWriter(tmp)
+	err = gob.NewEncoder(writer).Encode(snap)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(snap.Zones), os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot fills the cache with the zones saved at path. They're served
+// straight away, marked as unconfirmed, until the next serial poll checks
+// them against the driver.
+func (cache *CachingDriver) LoadSnapshot(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	snap := snapshot{}
+	if err := gob.NewDecoder(reader).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != snapshotVersion {
+		return 0, fmt.Errorf("Unknown snapshot version %d", snap.Version)
+	}
+
+	known := map[string]bool{}
+	for _, zonename := range snap.Known {
+		known[strings.ToLower(zonename)] = true
+	}
+	cache.mutex.Lock()
+	cache.known = known
+	cache.mutex.Unlock()
+
+	loaded := 0
+	for _, zone := range snap.Zones {
+		rrs := make([]dns.RR, 0, len(zone.Records))
+		for _, record := range zone.Records {
+			rr, err := dns.NewRR(record)
+			if err != nil || rr == nil {
+				log.Error(fmt.Sprintf("Error parsing snapshot record %s for %s: %s", record, zone.Name, err))
+				rrs = nil
+				break
+			}
+			rrs = append(rrs, rr)
+		}
+		if rrs == nil {
+			continue
+		}
+
+		cache.put(&cacheEntry{
+			key:         "axfr:" + zone.Name,
+			kind:        "axfr",
+			name:        zone.Name,
+			rrs:         rrs,
+			bytes:       rrsSize(rrs),
+			confirmed:   snap.Written,
+			unconfirmed: true,
+			serial:      zone.Serial,
+		}, cache.currentGeneration())
+		loaded++
+	}
+	return loaded, nil
+}
+
+func (cache *CachingDriver) currentGeneration() uint64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.generation
+}
+
+// StartSnapshots writes a snapshot to path every interval, and once more
+// when Stop is called, which waits for it.
+func (cache *CachingDriver) StartSnapshots(path string, interval time.Duration) {
+	stop := cache.stopChan()
+	cache.workers.Add(1)
+	go func() {
+		defer cache.workers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				cache.logSnapshot(path)
+				return
+			}
+			cache.logSnapshot(path)
+		}
+	}()
+}
+
+func (cache *CachingDriver) logSnapshot(path string) {
+	zones, err := cache.WriteSnapshot(path)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error writing snapshot %s: %s", path, err))
+		return
+	}
+	log.Debug(fmt.Sprintf("Wrote %d zones to snapshot %s", zones, path))
+}
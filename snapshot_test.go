@@ -0,0 +1,153 @@
+package mdns_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rackerlabs/mdns"
+)
+
+func TestSnapshot(t *testing.T) {
+	SetUp()
+
+	dir, err := ioutil.TempDir("", "mdns-snapshot")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "zones.snapshot")
+
+	cache := openCache(t, 1<<20)
+	_, err = cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	zones, err := cache.WriteSnapshot(path)
+	ok(t, err)
+	assert(t, zones == 1, fmt.Sprintf("Wrong number of zones written: %d", zones))
+
+	// Start again with the database down
+	mysql := &mdns.MySQLDriver{}
+	breakDB(mysql)
+	warm := mdns.NewCachingDriver(mysql, 1<<20)
+	zones, err = warm.LoadSnapshot(path)
+	ok(t, err)
+	assert(t, zones == 1, fmt.Sprintf("Wrong number of zones loaded: %d", zones))
+
+	rrs, err := warm.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	assert(t, len(rrs) == 3, fmt.Sprintf("Wrong number of records: %d", len(rrs)))
+
+	rrs, err = warm.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	assert(t, len(rrs) == 1, fmt.Sprintf("Wrong number of records: %d", len(rrs)))
+}
+
+func TestSnapshotRevalidate(t *testing.T) {
+	SetUp()
+
+	dir, err := ioutil.TempDir("", "mdns-snapshot")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "zones.snapshot")
+
+	cache := openCache(t, 1<<20)
+	_, err = cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	_, err = cache.WriteSnapshot(path)
+	ok(t, err)
+
+	warm := openCache(t, 1<<20)
+	_, err = warm.LoadSnapshot(path)
+	ok(t, err)
+
+	// The serial hasn't changed, so the zone stays
+	ok(t, warm.PollSerials())
+	equals(t, 1, warm.Stats().Entries)
+}
+
+func TestSnapshotOnStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdns-snapshot")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "zones.snapshot")
+
+	cache := mdns.NewCachingDriver(openGomdns(t), 1<<20)
+	_, err = cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	cache.StartSnapshots(path, time.Hour)
+
+	// Stop only returns once the last snapshot is written
+	cache.Stop()
+	zones, err := mdns.NewCachingDriver(mdns.NewMemoryDriver(), 1<<20).LoadSnapshot(path)
+	ok(t, err)
+	equals(t, 1, zones)
+}
+
+func TestSnapshotStaleLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdns-snapshot")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "zones.snapshot")
+
+	cache := mdns.NewCachingDriver(openGomdns(t), 1<<20)
+	_, err = cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	_, err = cache.WriteSnapshot(path)
+	ok(t, err)
+
+	// Start again with nothing behind the cache
+	warm := mdns.NewCachingDriver(mdns.NewMemoryDriver(), 1<<20)
+	warm.StaleLimits(time.Hour, 30)
+	_, err = warm.LoadSnapshot(path)
+	ok(t, err)
+	rrs, err := warm.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	equals(t, 1, len(rrs))
+	equals(t, uint32(30), rrs[0].Header().Ttl)
+
+	// Past the limit the snapshot isn't served
+	warm.StaleLimits(time.Nanosecond, 30)
+	rrs, err = warm.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	equals(t, 0, len(rrs))
+	_, err = warm.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	assert(t, err != nil, "an unconfirmed AXFR past the limit should not be served")
+}
+
+func TestSnapshotChildZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdns-snapshot")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "zones.snapshot")
+
+	memory := openGomdns(t)
+	ok(t, memory.SetZoneText("sub.gomdns.com.", `$ORIGIN sub.gomdns.com.
+@	3600 IN SOA ns1.designate.com. hostmaster.sub.gomdns.com. 1 3600 600 86400 3600
+@	3600 IN NS ns1.designate.com.
+`))
+	// Only the parent is cached, but the poll knows of both zones
+	cache := mdns.NewCachingDriver(memory, 1<<20)
+	ok(t, cache.PollSerials())
+	_, err = cache.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	zones, err := cache.WriteSnapshot(path)
+	ok(t, err)
+	equals(t, 1, zones)
+
+	warm := mdns.NewCachingDriver(memory, 1<<20)
+	_, err = warm.LoadSnapshot(path)
+	ok(t, err)
+
+	// The child's names aren't answered from the parent's snapshot
+	rrs, err := warm.GetQueryRRs(mdns.NewRequestContext(), "sub.gomdns.com.", "SOA")
+	ok(t, err)
+	equals(t, 1, len(rrs))
+	equals(t, "sub.gomdns.com.", rrs[0].Header().Name)
+}
+
+func TestSnapshotMissing(t *testing.T) {
+	cache := mdns.NewCachingDriver(&mdns.MySQLDriver{}, 1<<20)
+	_, err := cache.LoadSnapshot("/nonexistent/zones.snapshot")
+	assert(t, err != nil, "Loading a missing snapshot should be an error")
+}
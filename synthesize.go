@@ -0,0 +1,131 @@
+package mdns
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+//
+// Synthesized Records
+//
+
+// poolNameservers returns the hostnames in a pool's pool_ns_records, by
+// priority.
+func (mysql *MySQLDriver) poolNameservers(ctx context.Context, poolId string) ([]string, error) {
+	var hostnames []string
+	err := mysql.read(ctx, func(db *sqlx.DB) error {
+		hostnames = nil
+		start := time.Now()
+		err := db.SelectContext(ctx, &hostnames,
+			`SELECT hostname
+		       FROM pool_ns_records
+		       WHERE pool_id = ?
+		       ORDER BY priority, hostname`, poolId)
+		observeDBQuery("pool_ns_records", start, err)
+		return err
+	})
+	if err != nil {
+		LoggerFrom(ctx).Error(fmt.Sprintf("Error fetching nameservers for pool %s: %s", poolId, err))
+		return nil, err
+	}
+	return hostnames, nil
+}
+
+// isApex reports whether rr is a record of type rrtype at the apex of zone.
+func isApex(rr RR, zone Zone, rrtype string) bool {
+	return rr.Rrtype == rrtype && strings.EqualFold(rr.Name, zone.Name)
+}
+
+// replaceApex swaps the stored records of type rrtype at the apex of zone
+// for the synthesized ones.
+func replaceApex(rrs []RR, zone Zone, rrtype string, synthesized []RR) []RR {
+	kept := []RR{}
+	for _, rr := range rrs {
+		if !isApex(rr, zone, rrtype) {
+			kept = append(kept, rr)
+		}
+	}
+	return append(kept, synthesized...)
+}
+
+func synthesizedRR(zone Zone, rrtype string, data string) RR {
+	return RR{
+		Id:     "synthesized",
+		Rrtype: rrtype,
+		Ttl:    sql.NullInt64{Int64: zone.Ttl, Valid: true},
+		Name:   zone.Name,
+		Data:   data,
+		Status: "ACTIVE",
+		Action: "NONE",
+	}
+}
+
+// soaMailbox turns an email address into the mailbox form used in an SOA,
+// escaping any dots in the local part. e.g. "joe.b@example.com" becomes
+// "joe\.b.example.com."
+func soaMailbox(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return dns.Fqdn(email)
+	}
+	local := strings.Replace(email[:at], ".", "\\.", -1)
+	return dns.Fqdn(local + "." + email[at+1:])
+}
+
+// synthesizedSOA builds the SOA of zone from its zones row, with the pool's
+// first nameserver as the primary.
+func synthesizedSOA(zone Zone, hostnames []string) (RR, error) {
+	if len(hostnames) == 0 {
+		return RR{}, fmt.Errorf("can't build an SOA for %s, pool %s has no nameservers", zone.Name, zone.PoolId)
+	}
+	data := fmt.Sprintf("%s %s %d %d %d %d %d", hostnames[0], soaMailbox(zone.Email),
+		zone.Serial, zone.Refresh, zone.Retry, zone.Expire, zone.Minimum)
+	return synthesizedRR(zone, "SOA", data), nil
+}
+
+// synthesizeApex replaces the apex records stored for zone with ones built
+// from the zones row and its pool's nameservers, for each of -synthesize_ns
+// and -synthesize_soa that is on. Designate treats those as the source of
+// truth, and the stored copies can drift from them. Only the types an rrtype
+// query would return are replaced; AXFR replaces both.
+func (mysql *MySQLDriver) synthesizeApex(ctx context.Context, zone Zone, rrtype string, rrs []RR) ([]RR, error) {
+	wants := func(t string) bool {
+		return rrtype == t || rrtype == "ANY" || rrtype == "AXFR"
+	}
+	synthesizeNS := Conf.SynthesizeNS && wants("NS")
+	synthesizeSOA := Conf.SynthesizeSOA && wants("SOA")
+	if !synthesizeNS && !synthesizeSOA {
+		return rrs, nil
+	}
+
+	hostnames, err := mysql.poolNameservers(ctx, zone.PoolId)
+	if err != nil {
+		return nil, err
+	}
+
+	if synthesizeNS {
+		if len(hostnames) == 0 {
+			LoggerFrom(ctx).Warn(fmt.Sprintf("Pool %s has no nameservers, serving the stored NS records for %s", zone.PoolId, zone.Name))
+		} else {
+			ns := []RR{}
+			for _, hostname := range hostnames {
+				ns = append(ns, synthesizedRR(zone, "NS", hostname))
+			}
+			rrs = replaceApex(rrs, zone, "NS", ns)
+		}
+	}
+	if synthesizeSOA {
+		soa, err := synthesizedSOA(zone, hostnames)
+		if err != nil {
+			LoggerFrom(ctx).Error(err.Error())
+			return nil, err
+		}
+		rrs = replaceApex(rrs, zone, "SOA", []RR{soa})
+	}
+	return rrs, nil
+}
@@ -0,0 +1,117 @@
+package mdns_test
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/miekg/dns"
+	"testing"
+
+	"github.com/rackerlabs/mdns"
+)
+
+// addPoolNameserver adds a nameserver to the pool gomdns.com. is in, and
+// returns a func that removes it again.
+func addPoolNameserver(t *testing.T, hostname string) func() {
+	db, err := sqlx.Open(mdns.Conf.DbType, mdns.Conf.DbConn)
+	ok(t, err)
+	id := "00000000000000000000000000mdnsns"
+	_, err = db.Exec(`INSERT INTO pool_ns_records (id, version, pool_id, priority, hostname)
+	       VALUES (?, 1, '794ccc2cd75144feb57f8894c9f5c842', 2, ?)`, id, hostname)
+	ok(t, err)
+	return func() {
+		db.Exec(`DELETE FROM pool_ns_records WHERE id = ?`, id)
+		db.Close()
+	}
+}
+
+func nsHosts(rrs []dns.RR) []string {
+	hosts := []string{}
+	for _, rr := range rrs {
+		if ns, isNS := rr.(*dns.NS); isNS {
+			hosts = append(hosts, ns.Ns)
+		}
+	}
+	return hosts
+}
+
+func TestSynthesizeNSAxfr(t *testing.T) {
+	SetUp()
+	mdns.Conf.SynthesizeNS = true
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	defer addPoolNameserver(t, "ns2.designate.com.")()
+
+	rrs, err := mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	equals(t, 4, len(rrs))
+	equals(t, []string{"ns1.designate.com.", "ns2.designate.com."}, nsHosts(rrs))
+}
+
+func TestSynthesizeNSQuery(t *testing.T) {
+	SetUp()
+	mdns.Conf.SynthesizeNS = true
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	defer addPoolNameserver(t, "ns2.designate.com.")()
+
+	rrs, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "NS")
+	ok(t, err)
+	equals(t, []string{"ns1.designate.com.", "ns2.designate.com."}, nsHosts(rrs))
+	equals(t, uint32(3600), rrs[0].Header().Ttl)
+}
+
+func TestSynthesizeNSOff(t *testing.T) {
+	SetUp()
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	defer addPoolNameserver(t, "ns2.designate.com.")()
+
+	rrs, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "NS")
+	ok(t, err)
+	equals(t, []string{"ns1.designate.com."}, nsHosts(rrs))
+}
+
+// setSerial sets the serial of gomdns.com. in the zones table, and returns a
+// func that puts it back.
+func setSerial(t *testing.T, serial uint32) func() {
+	db, err := sqlx.Open(mdns.Conf.DbType, mdns.Conf.DbConn)
+	ok(t, err)
+	var original uint32
+	ok(t, db.Get(&original, `SELECT serial FROM zones WHERE name = 'gomdns.com.'`))
+	_, err = db.Exec(`UPDATE zones SET serial = ? WHERE name = 'gomdns.com.'`, serial)
+	ok(t, err)
+	return func() {
+		db.Exec(`UPDATE zones SET serial = ? WHERE name = 'gomdns.com.'`, original)
+		db.Close()
+	}
+}
+
+func TestSynthesizeSOAQuery(t *testing.T) {
+	SetUp()
+	mdns.Conf.SynthesizeSOA = true
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	defer setSerial(t, 1458672999)()
+
+	rrs, err := mysql.GetQueryRRs(mdns.NewRequestContext(), "gomdns.com.", "SOA")
+	ok(t, err)
+	equals(t, 1, len(rrs))
+	soa := rrs[0].(*dns.SOA)
+	equals(t, "ns1.designate.com.", soa.Ns)
+	equals(t, "joe.example.com.", soa.Mbox)
+	equals(t, uint32(1458672999), soa.Serial)
+	equals(t, []uint32{3546, 600, 86400, 3600}, []uint32{soa.Refresh, soa.Retry, soa.Expire, soa.Minttl})
+}
+
+func TestSynthesizeSOAAxfr(t *testing.T) {
+	SetUp()
+	mdns.Conf.SynthesizeSOA = true
+	mysql := &mdns.MySQLDriver{}
+	ok(t, mysql.Open())
+	defer setSerial(t, 1458672999)()
+
+	rrs, err := mysql.GetFullAxfrRRs(mdns.NewRequestContext(), "gomdns.com.")
+	ok(t, err)
+	equals(t, 3, len(rrs))
+	equals(t, uint32(1458672999), rrs[0].(*dns.SOA).Serial)
+	equals(t, uint32(1458672999), rrs[2].(*dns.SOA).Serial)
+}
@@ -0,0 +1,57 @@
+-- One record of each type mdns serves, in the zone recordtypes.com.
+--
+-- Newer Designate releases accept more record types than the schema in
+-- designate.sql, so the recordsets.type enum is widened first. TYPE65280 is a
+-- private use type that no one knows, stored in the RFC 3597 generic form.
+ALTER TABLE `recordsets` MODIFY `type` enum('A','AAAA','CNAME','MX','SRV','TXT','SPF','NS','PTR','SSHFP','SOA','NAPTR','CAA','CERT','DS','DNSKEY','TLSA','SMIMEA','OPENPGPKEY','URI','LOC','HINFO','HTTPS','SVCB','TYPE65280') NOT NULL;
+INSERT INTO `zones` VALUES ('7e9a1c3b5d2f4e6a8b0c1d2e3f405162','2016-03-22 18:00:00','2016-03-22 18:00:00',1,'noauth-project','recordtypes.com.','nsadmin@recordtypes.com',3600,3600,600,86400,3600,NULL,1,'0',NULL,NULL,'ACTIVE','NONE','794ccc2cd75144feb57f8894c9f5c842','.moc.sepytdrocer','PRIMARY',NULL,3000,0);
+INSERT INTO `recordsets` VALUES ('c3dee6f9c8eec31c2a1cc876fae49894','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','recordtypes.com.','SOA',NULL,NULL,'.moc.sepytdrocer',3000),
+  ('44679e8447c21727762869c87df32dd5','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','recordtypes.com.','NS',NULL,NULL,'.moc.sepytdrocer',3000),
+  ('69681d78738802bff08f615268665d0c','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','a.recordtypes.com.','A',NULL,NULL,'.moc.sepytdrocer.a',3000),
+  ('3d3da61d241a57aa8893fb3faa057732','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','aaaa.recordtypes.com.','AAAA',NULL,NULL,'.moc.sepytdrocer.aaaa',3000),
+  ('6b716ed3e79c21225f92818a6220ce3e','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','cname.recordtypes.com.','CNAME',NULL,NULL,'.moc.sepytdrocer.emanc',3000),
+  ('8897621b5b99d99b1530bb41e160f488','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','recordtypes.com.','MX',NULL,NULL,'.moc.sepytdrocer',3000),
+  ('b75b8bc7e76798f47f6672f8bb6ce0b5','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','_sip._tcp.recordtypes.com.','SRV',NULL,NULL,'.moc.sepytdrocer.pct_.pis_',3000),
+  ('fa30e624a56217213eae90235ae2a9ea','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','txt.recordtypes.com.','TXT',NULL,NULL,'.moc.sepytdrocer.txt',3000),
+  ('001d1ab88860d2c3d81ed2a8a9b2556c','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','recordtypes.com.','SPF',NULL,NULL,'.moc.sepytdrocer',3000),
+  ('75769dd7dbec49355fd7465a44999c55','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','1.2.0.192.recordtypes.com.','PTR',NULL,NULL,'.moc.sepytdrocer.291.0.2.1',3000),
+  ('dafa24cdcecd0504ab843dd81b8e307c','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','a.recordtypes.com.','SSHFP',NULL,NULL,'.moc.sepytdrocer.a',3000),
+  ('231258068c0ae76be1a946169b0f8f7b','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','naptr.recordtypes.com.','NAPTR',NULL,NULL,'.moc.sepytdrocer.rtpan',3000),
+  ('d4bf0fda9cc4631b2024a3e2bbd10f7f','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','recordtypes.com.','CAA',NULL,NULL,'.moc.sepytdrocer',3000),
+  ('cea749757c6c895989b4405961584df8','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','cert.recordtypes.com.','CERT',NULL,NULL,'.moc.sepytdrocer.trec',3000),
+  ('25f8d54e7b0bab5faff07c66eb7c4cd4','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','child.recordtypes.com.','DS',NULL,NULL,'.moc.sepytdrocer.dlihc',3000),
+  ('5b5a8346a99d356357ed3920e4c61866','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','child.recordtypes.com.','DNSKEY',NULL,NULL,'.moc.sepytdrocer.dlihc',3000),
+  ('51e1d6ff40c6adeb762f2ec634072e4b','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','_443._tcp.recordtypes.com.','TLSA',NULL,NULL,'.moc.sepytdrocer.pct_.344_',3000),
+  ('344fe71363720eeb70dcbabc3cd5985b','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','c93f._smimecert.recordtypes.com.','SMIMEA',NULL,NULL,'.moc.sepytdrocer.trecemims_.f39c',3000),
+  ('46177d03bfc6d989c16a95971194638f','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','c93f._openpgpkey.recordtypes.com.','OPENPGPKEY',NULL,NULL,'.moc.sepytdrocer.yekpgpnepo_.f39c',3000),
+  ('24f3c0717be6241f9c575bcc0e7d2165','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','_http._tcp.recordtypes.com.','URI',NULL,NULL,'.moc.sepytdrocer.pct_.ptth_',3000),
+  ('157f53ab4aadd235892f2149d45ddc0b','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','loc.recordtypes.com.','LOC',NULL,NULL,'.moc.sepytdrocer.col',3000),
+  ('fabc52a184177a35379988c4061344ec','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','hinfo.recordtypes.com.','HINFO',NULL,NULL,'.moc.sepytdrocer.ofnih',3000),
+  ('150a1f18886f1fe05db529df75bfe852','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','recordtypes.com.','HTTPS',NULL,NULL,'.moc.sepytdrocer',3000),
+  ('86d6124266c0f13eb64a709d02945db8','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','_svc.recordtypes.com.','SVCB',NULL,NULL,'.moc.sepytdrocer.cvs_',3000),
+  ('9ee9d022ff70f1a7fe3997d354cad6cd','2016-03-22 18:00:00',NULL,1,'noauth-project','7e9a1c3b5d2f4e6a8b0c1d2e3f405162','generic.recordtypes.com.','TYPE65280',NULL,NULL,'.moc.sepytdrocer.cireneg',3000);
+INSERT INTO `records` VALUES ('9e6f6774c0d879b3e252d724b5f7752b','2016-03-22 18:00:00',NULL,1,'ns1.designate.com. nsadmin.recordtypes.com. 1 3600 600 86400 3600','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'d2e24d53fc018fe8860cbf1e6e2487e5',NULL,'ACTIVE','noauth-project','c3dee6f9c8eec31c2a1cc876fae49894',NULL,NULL,NULL,'NONE',1,3000),
+  ('356c2fff3fb0c6e804678f366ae6e839','2016-03-22 18:00:00',NULL,1,'ns1.designate.com.','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'e6a606636004da9931401d7abb7fc476',NULL,'ACTIVE','noauth-project','44679e8447c21727762869c87df32dd5',NULL,NULL,NULL,'NONE',1,3000),
+  ('c63393125692099628f1d1739d7b0f3a','2016-03-22 18:00:00',NULL,1,'192.0.2.1','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'c329a225c2a773d29abb19883e084db7',NULL,'ACTIVE','noauth-project','69681d78738802bff08f615268665d0c',NULL,NULL,NULL,'NONE',1,3000),
+  ('88b374d9ca6911eafc7ff50c84794c9f','2016-03-22 18:00:00',NULL,1,'2001:db8::1','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'60b138c64e615dfd66ad34e85d497b3b',NULL,'ACTIVE','noauth-project','3d3da61d241a57aa8893fb3faa057732',NULL,NULL,NULL,'NONE',1,3000),
+  ('043d4c92f7c07552ec9abbfec8d215a7','2016-03-22 18:00:00',NULL,1,'a.recordtypes.com.','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'9ac4514cedd6deec3e56fe467fc9c191',NULL,'ACTIVE','noauth-project','6b716ed3e79c21225f92818a6220ce3e',NULL,NULL,NULL,'NONE',1,3000),
+  ('8b960e5cbd093a7f02b8995b259c3041','2016-03-22 18:00:00',NULL,1,'10 mail.recordtypes.com.','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'3bee56daabcfdd85d8c0b343de0579d8',NULL,'ACTIVE','noauth-project','8897621b5b99d99b1530bb41e160f488',NULL,NULL,NULL,'NONE',1,3000),
+  ('ef1bbefd6cfdd73b17206296ee754cff','2016-03-22 18:00:00',NULL,1,'10 60 5060 sip.recordtypes.com.','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'66f61e57acf23c54aa8f89ab363e1b66',NULL,'ACTIVE','noauth-project','b75b8bc7e76798f47f6672f8bb6ce0b5',NULL,NULL,NULL,'NONE',1,3000),
+  ('2b193b4a3725e37598a2f83e84cdd219','2016-03-22 18:00:00',NULL,1,'"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQ"','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'313bd2446ec106b29745bffe5d668aa8',NULL,'ACTIVE','noauth-project','fa30e624a56217213eae90235ae2a9ea',NULL,NULL,NULL,'NONE',1,3000),
+  ('9bb4244ba6126a4993588d6bdf62a9b2','2016-03-22 18:00:00',NULL,1,'"v=spf1 ip4:192.0.2.0/24 -all"','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'851cb6d12226d069d62c84fb46a184bf',NULL,'ACTIVE','noauth-project','001d1ab88860d2c3d81ed2a8a9b2556c',NULL,NULL,NULL,'NONE',1,3000),
+  ('ad57a21eb425bc5b95125fa51ac11cd9','2016-03-22 18:00:00',NULL,1,'a.recordtypes.com.','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'f9f98340cf8a9388e6f1a0382b5382ff',NULL,'ACTIVE','noauth-project','75769dd7dbec49355fd7465a44999c55',NULL,NULL,NULL,'NONE',1,3000),
+  ('9a7719d0d09ec198aa90988d11569e78','2016-03-22 18:00:00',NULL,1,'1 2 123456789abcdef67890123456789abcdef67890123456789abcdef123456789','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'db4dbc2cf650d26f2b2b81cca7405c33',NULL,'ACTIVE','noauth-project','dafa24cdcecd0504ab843dd81b8e307c',NULL,NULL,NULL,'NONE',1,3000),
+  ('1499bb47cbd02d2adf75e93ea765cb3c','2016-03-22 18:00:00',NULL,1,'100 10 "S" "SIP+D2U" "" _sip._udp.recordtypes.com.','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'fc81057a0f630d400ce2579d0350fc81',NULL,'ACTIVE','noauth-project','231258068c0ae76be1a946169b0f8f7b',NULL,NULL,NULL,'NONE',1,3000),
+  ('f5f6220357b8303938cec4f77c1d4136','2016-03-22 18:00:00',NULL,1,'0 issue "ca.example.net"','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'80daf909967034e58f728f7cfba6069f',NULL,'ACTIVE','noauth-project','d4bf0fda9cc4631b2024a3e2bbd10f7f',NULL,NULL,NULL,'NONE',1,3000),
+  ('52fe7a15482a05b7857e1955b51fbb29','2016-03-22 18:00:00',NULL,1,'PGP 0 0 dGVzdA==','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'edd075db533fe4e3011e62aa029dcbaa',NULL,'ACTIVE','noauth-project','cea749757c6c895989b4405961584df8',NULL,NULL,NULL,'NONE',1,3000),
+  ('561e3b7b57f4cd6097e5df410d7d32ca','2016-03-22 18:00:00',NULL,1,'60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'7ceb8837730936e5245e0fca6ef14ec4',NULL,'ACTIVE','noauth-project','25f8d54e7b0bab5faff07c66eb7c4cd4',NULL,NULL,NULL,'NONE',1,3000),
+  ('bea32eaeb13fefb7beed3afdf4796422','2016-03-22 18:00:00',NULL,1,'257 3 8 AwEAAagAIKlVZrpC6Ia7gEzahOR+9W29euxhJhVVLOyQbSEW0O8gcCjF','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'b427f5f81efa3fd949dccf56fe8a66e2',NULL,'ACTIVE','noauth-project','5b5a8346a99d356357ed3920e4c61866',NULL,NULL,NULL,'NONE',1,3000),
+  ('59704a41a6b11f1bccccf5006592ed2f','2016-03-22 18:00:00',NULL,1,'3 1 1 0C72AC70B745AC19998811B131D662C9AC69DBDBE7CB23E5B514B56664C5D3D6','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'1f4d2ced9b111c6c5e03832e79a9dfb0',NULL,'ACTIVE','noauth-project','51e1d6ff40c6adeb762f2ec634072e4b',NULL,NULL,NULL,'NONE',1,3000),
+  ('14075a79e27db5398838272b405965d3','2016-03-22 18:00:00',NULL,1,'3 0 1 0C72AC70B745AC19998811B131D662C9AC69DBDBE7CB23E5B514B56664C5D3D6','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'d99cf1f0ac5880212cfb290eff23d250',NULL,'ACTIVE','noauth-project','344fe71363720eeb70dcbabc3cd5985b',NULL,NULL,NULL,'NONE',1,3000),
+  ('fbd6d2290b6097808b1882221c88db9b','2016-03-22 18:00:00',NULL,1,'dGVzdA==','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'764e541b5195c63a8ee2c60217d61c26',NULL,'ACTIVE','noauth-project','46177d03bfc6d989c16a95971194638f',NULL,NULL,NULL,'NONE',1,3000),
+  ('44b0ed7df1e18f087b185e38bd9e83da','2016-03-22 18:00:00',NULL,1,'10 1 "https://www.recordtypes.com/"','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'1a9e659a8d4f01db3c2e92286b94b95e',NULL,'ACTIVE','noauth-project','24f3c0717be6241f9c575bcc0e7d2165',NULL,NULL,NULL,'NONE',1,3000),
+  ('b2fe3d96362171011e4d97db8d58050f','2016-03-22 18:00:00',NULL,1,'51 30 12.748 N 0 7 39.611 W 0.00m 0.00m 0.00m 0.00m','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'eda12c1d31f9e3c644ad974b73471556',NULL,'ACTIVE','noauth-project','157f53ab4aadd235892f2149d45ddc0b',NULL,NULL,NULL,'NONE',1,3000),
+  ('9b4fea3b178fee1408dd7c334726f6ee','2016-03-22 18:00:00',NULL,1,'"PC" "Linux"','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'fe9ceed3d2e12b707e4929ef90d3c2da',NULL,'ACTIVE','noauth-project','fabc52a184177a35379988c4061344ec',NULL,NULL,NULL,'NONE',1,3000),
+  ('53f13f678171d8c048162a257d9bf44e','2016-03-22 18:00:00',NULL,1,'1 . alpn="h2,h3"','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'60ee08f210a65bcb66bb062a684314a0',NULL,'ACTIVE','noauth-project','150a1f18886f1fe05db529df75bfe852',NULL,NULL,NULL,'NONE',1,3000),
+  ('e41ee328ba00d5cdc3b8415cad4b0ff3','2016-03-22 18:00:00',NULL,1,'1 svc.recordtypes.com. port=8443','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'2acefaee0cc09643f6c14f47945fdc02',NULL,'ACTIVE','noauth-project','86d6124266c0f13eb64a709d02945db8',NULL,NULL,NULL,'NONE',1,3000),
+  ('463d0f102d2adba398158da77162ae26','2016-03-22 18:00:00',NULL,1,'\\# 4 0A000001','7e9a1c3b5d2f4e6a8b0c1d2e3f405162',0,NULL,NULL,NULL,NULL,'8223e5dd6cb60e6a97ff6ae9ab526b40',NULL,'ACTIVE','noauth-project','9ee9d022ff70f1a7fe3997d354cad6cd',NULL,NULL,NULL,'NONE',1,3000);
@@ -2,6 +2,7 @@ package mdns_test
 
 import (
 	"fmt"
+	"net"
 	"path/filepath"
 	"reflect"
 	"runtime"
@@ -40,12 +41,19 @@ func equals(tb testing.TB, exp, act interface{}) {
 
 func SetTestConfig() {
 	mdns.Conf = mdns.Config{
-		Version:     false,
-		Debug:       true,
-		BindAddress: "127.0.0.1",
-		BindPort:    "5354",
-		DbType:      "mysql",
-		DbConn:      "root:password@tcp(127.0.0.1:3306)/designate",
+		Version:   false,
+		Debug:     true,
+		LogFormat: "text",
+		Listen: []mdns.ListenAddr{
+			mdns.ListenAddr{Net: "tcp", Host: "127.0.0.1", Port: "5354"},
+			mdns.ListenAddr{Net: "udp", Host: "127.0.0.1", Port: "5354"},
+		},
+		NotifyAllow: []*net.IPNet{
+			&net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)},
+			&net.IPNet{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+		},
+		DbType: "mysql",
+		DbConn: "root:password@tcp(127.0.0.1:3306)/designate",
 	}
 }
 
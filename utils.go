@@ -1,15 +1,23 @@
 package mdns
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
 	"github.com/vharitonsky/iniflags"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 //
@@ -18,44 +26,309 @@ import (
 var Conf Config
 
 type Config struct {
-	Version     bool
-	Debug       bool
-	BindAddress string
-	BindPort    string
-	DbType      string
-	DbConn      string
+	Version           bool
+	Debug             bool
+	LogFormat         string
+	Listen            []ListenAddr
+	HttpAddress       string
+	CanaryZone        string
+	DnstapSocket      string
+	DnstapFile        string
+	DnstapBuffer      int
+	Cache             bool
+	CacheMaxBytes     int
+	CachePollInterval time.Duration
+	AxfrCacheMaxBytes int
+	ServeStale        bool
+	ServeStaleMaxAge  time.Duration
+	ServeStaleTtl     uint
+	SnapshotPath      string
+	SnapshotInterval  time.Duration
+	DbType            string
+	ZoneDir           string
+	ZoneDirInterval   time.Duration
+	QueryTimeout      time.Duration
+	StatusPolicy      string
+	SynthesizeNS      bool
+	SynthesizeSOA     bool
+	StrictRecords     bool
+	SpfAsTxt          bool
+	Shards            *ShardRange
+	Secondary         bool
+	SecondaryInterval time.Duration
+	SecondaryWorkers  int
+	NotifyAllow       []*net.IPNet
+	AxfrTimeout       time.Duration
+	DbConn            string
+	DbReplicas        []string
+	DbMaxOpenConns    int
+	DbMaxIdleConns    int
+	DbConnMaxLifetime time.Duration
+	DbConnMaxIdleTime time.Duration
+	DbEjectErrors     int
+	DbPingInterval    time.Duration
+}
+
+// ListenAddr is a single address for mdns to serve DNS on.
+type ListenAddr struct {
+	Net  string
+	Host string
+	Port string
+}
+
+// Addr returns the host:port form of the address, bracketing IPv6 hosts.
+func (addr ListenAddr) Addr() string {
+	return net.JoinHostPort(addr.Host, addr.Port)
+}
+
+func (addr ListenAddr) String() string {
+	return fmt.Sprintf("%s/%s", addr.Net, addr.Addr())
+}
+
+// ParseListenAddr parses an address of the form proto/ip:port, where ip is
+// either an IPv4 address or a bracketed IPv6 address. e.g. "udp/[::1]:5354"
+func ParseListenAddr(s string) (ListenAddr, error) {
+	addr := ListenAddr{}
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	if len(parts) != 2 {
+		return addr, fmt.Errorf("listen address %q is missing a protocol (e.g. udp/127.0.0.1:5354)", s)
+	}
+
+	switch parts[0] {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		addr.Net = parts[0]
+	default:
+		return addr, fmt.Errorf("listen address %q has an unknown protocol %q", s, parts[0])
+	}
+
+	host, port, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		return addr, fmt.Errorf("listen address %q is invalid: %s", s, err)
+	}
+	if net.ParseIP(host) == nil {
+		return addr, fmt.Errorf("listen address %q does not have a valid IP", s)
+	}
+	if port == "" {
+		return addr, fmt.Errorf("listen address %q is missing a port", s)
+	}
+	addr.Host = host
+	addr.Port = port
+
+	return addr, nil
+}
+
+// ParseListenAddrs parses a comma separated list of listen addresses.
+func ParseListenAddrs(s string) ([]ListenAddr, error) {
+	addrs := []ListenAddr{}
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		addr, err := ParseListenAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen addresses configured")
+	}
+	return addrs, nil
+}
+
+// BindListenAddrs is what the deprecated -bind_address and -bind_port flags
+// mean in -listen terms: TCP and UDP on the one address, 127.0.0.1 and 5354
+// unless given.
+func BindListenAddrs(address string, port string) ([]ListenAddr, error) {
+	if address == "" {
+		address = "127.0.0.1"
+	}
+	if port == "" {
+		port = "5354"
+	}
+	host := net.JoinHostPort(address, port)
+	return ParseListenAddrs(fmt.Sprintf("tcp/%s,udp/%s", host, host))
+}
+
+// ParseNotifyAllow parses a comma separated list of IPs and CIDRs, like
+// "127.0.0.1,192.0.2.0/24". An empty list allows no one.
+func ParseNotifyAllow(s string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, item := range splitList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", item)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
 }
 
 func InitConfig() Config {
 	// Provide a '--version' flag
 	version := flag.Bool("version", false, "prints version information")
 	debug := flag.Bool("debug", false, "enables debug mode")
-	bind_address := flag.String("bind_address", "127.0.0.1", "IP to listen on")
-	bind_port := flag.String("bind_port", "5354", "port to listen on")
+	log_format := flag.String("log_format", "text", "log output format (text, json)")
+	listen := flag.String("listen", "tcp/127.0.0.1:5354,udp/127.0.0.1:5354",
+		"comma separated list of proto/ip:port to listen on, IPv6 addresses must be bracketed")
+	bind_address := flag.String("bind_address", "", "deprecated, use -listen: IP to listen on over TCP and UDP")
+	bind_port := flag.String("bind_port", "", "deprecated, use -listen: port to listen on over TCP and UDP")
+	http_address := flag.String("http_address", "127.0.0.1:9153", "ip:port to serve /metrics, /healthz and /readyz on, empty to disable")
+	canary_zone := flag.String("canary_zone", "", "zone whose SOA must be found for /readyz to pass, empty to skip")
+	dnstap_socket := flag.String("dnstap_socket", "", "Frame Streams unix socket to send dnstap frames to")
+	dnstap_file := flag.String("dnstap_file", "", "file to write dnstap frames to, if no dnstap_socket is set")
+	dnstap_buffer := flag.Int("dnstap_buffer", 4096, "dnstap frames to buffer before dropping them")
+	cache := flag.Bool("cache", true, "cache records in memory, invalidated when the zone serial changes")
+	cache_max_bytes := flag.Int("cache_max_bytes", 64<<20, "approximate memory limit for cached records")
+	cache_poll_interval := flag.Duration("cache_poll_interval", 5*time.Second, "how often to check zone serials for changes")
+	axfr_cache_max_bytes := flag.Int("axfr_cache_max_bytes", 128<<20, "memory limit for packed AXFR messages kept per zone serial, 0 to disable")
+	serve_stale := flag.Bool("serve_stale", false, "answer from the last known-good cached data while the database is unavailable (needs -cache)")
+	serve_stale_max_age := flag.Duration("serve_stale_max_age", time.Hour, "how long after it was last current data can be served stale")
+	serve_stale_ttl := flag.Uint("serve_stale_ttl", 30, "TTL cap on stale query answers")
+	snapshot_path := flag.String("snapshot_path", "", "file to snapshot cached zones to, and warm the cache from at startup (needs -cache)")
+	snapshot_interval := flag.Duration("snapshot_interval", 5*time.Minute, "how often to write the snapshot")
+	query_timeout := flag.Duration("query_timeout", 2*time.Second, "how long a query may wait on the database before answering SERVFAIL, 0 for no limit")
+	axfr_timeout := flag.Duration("axfr_timeout", time.Minute, "how long an AXFR may take before it is abandoned, 0 for no limit")
+	status_policy := flag.String("status_policy", DefaultPolicy, "how zone and record status/action decide what is served (designate, active_only)")
+	synthesize_ns := flag.Bool("synthesize_ns", false, "serve apex NS records built from the pool's pool_ns_records, instead of the stored copies")
+	synthesize_soa := flag.Bool("synthesize_soa", false, "serve SOA records built from the zones table and the pool's primary nameserver, instead of the stored copies")
+	strict_records := flag.Bool("strict_records", false, "fail the whole AXFR or query when a record's data doesn't parse, instead of skipping the record")
+	spf_as_txt := flag.Bool("spf_as_txt", false, "serve each SPF record as a TXT record as well")
+	shards := flag.String("shards", "", "range of zone shards to serve, e.g. 0-2047, empty for all of them")
+	secondary := flag.Bool("secondary", false, "transfer SECONDARY zones from their zone_masters, and serve the copies")
+	secondary_interval := flag.Duration("secondary_interval", 5*time.Second, "how often to re-read the secondary zones and check the ones due a refresh")
+	secondary_concurrency := flag.Int("secondary_concurrency", 10, "most secondary zones to check and transfer at once")
+	notify_allow := flag.String("notify_allow", "127.0.0.1,::1", "comma separated IPs and CIDRs to accept NOTIFYs from, besides a secondary zone's masters")
+	zone_dir := flag.String("zone_dir", "", "serve the <zone>.zone files in this directory instead of the database")
+	zone_dir_interval := flag.Duration("zone_dir_interval", 5*time.Second, "how often to check -zone_dir for changed zone files")
 	db_type := flag.String("db_type", "mysql", "type of db connection (mysql, postgres, sqlite3)")
-	db_conn := flag.String("db", "root:password@tcp(127.0.0.1:3306)/designate", "db connection string")
+	db_conn := flag.String("db", "root:password@tcp(127.0.0.1:3306)/designate", "db connection string of the primary")
+	db_replicas := flag.String("db_replicas", "", "comma separated db connection strings of read replicas to spread lookups across")
+	db_max_open_conns := flag.Int("db_max_open_conns", 50, "most connections open to each db endpoint, 0 for no limit")
+	db_max_idle_conns := flag.Int("db_max_idle_conns", 10, "most idle connections kept to each db endpoint, 0 for the default of 2")
+	db_conn_max_lifetime := flag.Duration("db_conn_max_lifetime", 5*time.Minute, "how long a db connection is reused before it is closed, 0 for forever")
+	db_conn_max_idle_time := flag.Duration("db_conn_max_idle_time", time.Minute, "how long a db connection may sit idle before it is closed, 0 for forever")
+	db_eject_errors := flag.Int("db_eject_errors", 3, "consecutive errors after which a db endpoint is taken out of rotation")
+	db_ping_interval := flag.Duration("db_ping_interval", 5*time.Second, "how often to ping ejected db endpoints to bring them back")
 	flag.Usage = func() {
 		flag.PrintDefaults()
 	}
 	// You can specify an .ini file with the -config
 	iniflags.Parse()
+
+	listenAddrs, err := ParseListenAddrs(*listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -listen: %s\n", err)
+		os.Exit(2)
+	}
+	if *bind_address != "" || *bind_port != "" {
+		listenSet := false
+		flag.Visit(func(f *flag.Flag) { listenSet = listenSet || f.Name == "listen" })
+		if listenSet {
+			fmt.Fprintln(os.Stderr, "-bind_address and -bind_port are deprecated, and ignored since -listen is set")
+		} else {
+			fmt.Fprintln(os.Stderr, "-bind_address and -bind_port are deprecated, use -listen instead")
+			listenAddrs, err = BindListenAddrs(*bind_address, *bind_port)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -bind_address or -bind_port: %s\n", err)
+				os.Exit(2)
+			}
+		}
+	}
+	if _, err := PolicyByName(*status_policy); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -status_policy: %s\n", err)
+		os.Exit(2)
+	}
+	shardRange, err := ParseShardRange(*shards)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -shards: %s\n", err)
+		os.Exit(2)
+	}
+	notifyAllow, err := ParseNotifyAllow(*notify_allow)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -notify_allow: %s\n", err)
+		os.Exit(2)
+	}
+
 	Conf = Config{
-		Version:     *version,
-		Debug:       *debug,
-		BindAddress: *bind_address,
-		BindPort:    *bind_port,
-		DbType:      *db_type,
-		DbConn:      *db_conn,
+		Version:           *version,
+		Debug:             *debug,
+		LogFormat:         *log_format,
+		Listen:            listenAddrs,
+		HttpAddress:       *http_address,
+		CanaryZone:        *canary_zone,
+		DnstapSocket:      *dnstap_socket,
+		DnstapFile:        *dnstap_file,
+		DnstapBuffer:      *dnstap_buffer,
+		Cache:             *cache,
+		CacheMaxBytes:     *cache_max_bytes,
+		CachePollInterval: *cache_poll_interval,
+		AxfrCacheMaxBytes: *axfr_cache_max_bytes,
+		ServeStale:        *serve_stale,
+		ServeStaleMaxAge:  *serve_stale_max_age,
+		ServeStaleTtl:     *serve_stale_ttl,
+		SnapshotPath:      *snapshot_path,
+		SnapshotInterval:  *snapshot_interval,
+		DbType:            *db_type,
+		ZoneDir:           *zone_dir,
+		ZoneDirInterval:   *zone_dir_interval,
+		QueryTimeout:      *query_timeout,
+		StatusPolicy:      *status_policy,
+		SynthesizeNS:      *synthesize_ns,
+		SynthesizeSOA:     *synthesize_soa,
+		StrictRecords:     *strict_records,
+		SpfAsTxt:          *spf_as_txt,
+		Shards:            shardRange,
+		Secondary:         *secondary,
+		SecondaryInterval: *secondary_interval,
+		SecondaryWorkers:  *secondary_concurrency,
+		NotifyAllow:       notifyAllow,
+		AxfrTimeout:       *axfr_timeout,
+		DbConn:            *db_conn,
+		DbReplicas:        splitList(*db_replicas),
+		DbMaxOpenConns:    *db_max_open_conns,
+		DbMaxIdleConns:    *db_max_idle_conns,
+		DbConnMaxLifetime: *db_conn_max_lifetime,
+		DbConnMaxIdleTime: *db_conn_max_idle_time,
+		DbEjectErrors:     *db_eject_errors,
+		DbPingInterval:    *db_ping_interval,
 	}
 	return Conf
 }
 
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 //
 // Logging
 //
 
 func InitLogging() {
-	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	if Conf.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	}
 	if Conf.Debug == true {
 		log.SetLevel(log.DebugLevel)
 	} else {
@@ -63,36 +336,164 @@ func InitLogging() {
 	}
 }
 
+// NewRequestId returns a random id used to tie together every log line
+// written while answering one request.
+func NewRequestId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// NewRequestLog returns a logger carrying a fresh request id.
+func NewRequestLog() *log.Entry {
+	return log.WithField("request_id", NewRequestId())
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx that carries logger down to the storage
+// calls made with it.
+func WithLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFrom returns the logger carried by ctx, or the standard logger.
+func LoggerFrom(ctx context.Context) *log.Entry {
+	if logger, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		return logger
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// NewRequestContext returns a context carrying a fresh request logger, with
+// no deadline.
+func NewRequestContext() context.Context {
+	return WithLogger(context.Background(), NewRequestLog())
+}
+
+// withTimeout is context.WithTimeout, except that a timeout of 0 means none.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 //
 // Utilities
 //
 
-func Serve(net, ip, port string, handler MdnsHandler) {
-	bind := fmt.Sprintf("%s:%s", ip, port)
-	server := &dns.Server{Addr: bind, Net: net, Handler: &handler}
+// Listeners are the DNS servers started by Serve. Errors receives any
+// error that stops one of them after it has started.
+type Listeners struct {
+	Servers []*dns.Server
+	Errors  chan error
+	mutex   sync.Mutex
+	bound   bool
+}
 
-	log.Info(fmt.Sprintf("starting mdns %s listener on %s", net, bind))
+// Serve binds every address and starts serving DNS on them. Binding happens
+// before Serve returns, so a port clash or a bad address is returned here
+// rather than killing the process from a goroutine.
+func Serve(addrs []ListenAddr, handler MdnsHandler) (*Listeners, error) {
+	listeners := &Listeners{Errors: make(chan error, len(addrs))}
 
-	err := server.ListenAndServe()
-	if err != nil {
-		panic(fmt.Sprintf("Failed to set up the %s server: %s", net, err.Error()))
+	for _, addr := range addrs {
+		server := &dns.Server{Addr: addr.Addr(), Net: addr.Net, Handler: &handler}
+
+		var err error
+		if strings.HasPrefix(addr.Net, "tcp") {
+			server.Listener, err = net.Listen(addr.Net, addr.Addr())
+		} else {
+			server.PacketConn, err = net.ListenPacket(addr.Net, addr.Addr())
+		}
+		if err != nil {
+			listeners.Shutdown()
+			return nil, fmt.Errorf("Failed to set up the %s listener on %s: %s", addr.Net, addr.Addr(), err)
+		}
+
+		log.Info(fmt.Sprintf("starting mdns %s listener on %s", addr.Net, addr.Addr()))
+		listeners.Servers = append(listeners.Servers, server)
+	}
+
+	// Every socket is open, so the listeners are bound until one of them
+	// fails. This has to happen before they start, or it could undo a
+	// failure that came first.
+	listeners.setBound(true)
+	for i, server := range listeners.Servers {
+		go func(server *dns.Server, addr ListenAddr) {
+			err := server.ActivateAndServe()
+			if err != nil {
+				listeners.setBound(false)
+				listeners.Errors <- fmt.Errorf("The %s listener on %s failed: %s", addr.Net, addr.Addr(), err)
+			}
+		}(server, addrs[i])
+	}
+	return listeners, nil
+}
+
+// Bound reports whether every listener is bound and serving.
+func (listeners *Listeners) Bound() bool {
+	listeners.mutex.Lock()
+	defer listeners.mutex.Unlock()
+	return listeners.bound
+}
+
+func (listeners *Listeners) setBound(bound bool) {
+	listeners.mutex.Lock()
+	listeners.bound = bound
+	listeners.mutex.Unlock()
+}
+
+// Shutdown stops every server, closing the sockets of any that never started.
+func (listeners *Listeners) Shutdown() {
+	listeners.setBound(false)
+	for _, server := range listeners.Servers {
+		if err := server.Shutdown(); err == nil {
+			continue
+		}
+		if server.Listener != nil {
+			server.Listener.Close()
+		}
+		if server.PacketConn != nil {
+			server.PacketConn.Close()
+		}
 	}
 }
 
-func Listen() {
-	SigQuit := make(chan os.Signal)
+// Listen blocks until mdns is told to stop or one of the listeners fails.
+// A listener failure is returned so the caller can exit non-zero. Each of
+// the reload funcs is called on SIGHUP.
+func Listen(listeners *Listeners, reload ...func()) error {
+	SigQuit := make(chan os.Signal, 1)
 	signal.Notify(SigQuit, syscall.SIGINT, syscall.SIGTERM)
-	SigStat := make(chan os.Signal)
+	SigStat := make(chan os.Signal, 1)
 	signal.Notify(SigStat, syscall.SIGUSR1)
+	SigReload := make(chan os.Signal, 1)
+	signal.Notify(SigReload, syscall.SIGHUP)
+	defer signal.Stop(SigQuit)
+	defer signal.Stop(SigStat)
+	defer signal.Stop(SigReload)
 
-forever:
 	for {
 		select {
 		case s := <-SigQuit:
 			log.Info(fmt.Sprintf("Signal (%d) received, stopping", s))
-			break forever
+			listeners.Shutdown()
+			return nil
+		case err := <-listeners.Errors:
+			listeners.Shutdown()
+			return err
 		case _ = <-SigStat:
 			log.Info(fmt.Sprintf("Goroutines: %d", runtime.NumGoroutine()))
+			logPoolStats()
+		case _ = <-SigReload:
+			log.Info("SIGHUP received, reloading")
+			for _, f := range reload {
+				f()
+			}
 		}
 	}
 }
@@ -1,10 +1,13 @@
 package mdns_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"os"
 	"testing"
-	"time"
 
 	"github.com/rackerlabs/mdns"
 )
@@ -14,8 +17,13 @@ func TestInitConfig(t *testing.T) {
 
 	assert(t, mdns.Conf.Version == false, "Version isn't false")
 	assert(t, mdns.Conf.Debug == false, "Debug isn't false")
-	assert(t, mdns.Conf.BindAddress == "127.0.0.1", "BindAddress isn't 127.0.0.1")
-	assert(t, mdns.Conf.BindPort == "5354", "BindPort isn't 5354")
+	assert(t, mdns.Conf.LogFormat == "text", "LogFormat isn't text")
+	equals(t, []mdns.ListenAddr{
+		mdns.ListenAddr{Net: "tcp", Host: "127.0.0.1", Port: "5354"},
+		mdns.ListenAddr{Net: "udp", Host: "127.0.0.1", Port: "5354"},
+	}, mdns.Conf.Listen)
+	assert(t, mdns.Conf.HttpAddress == "127.0.0.1:9153", "HttpAddress isn't 127.0.0.1:9153")
+	assert(t, mdns.Conf.Cache == true, "Cache isn't true")
 	assert(t, mdns.Conf.DbType == "mysql", "DbType isn't mysql")
 	assert(t, mdns.Conf.DbConn == "root:password@tcp(127.0.0.1:3306)/designate", "DbConn is wrong")
 }
@@ -25,8 +33,10 @@ func TestSetTestConfig(t *testing.T) {
 
 	assert(t, mdns.Conf.Version == false, "Version isn't false")
 	assert(t, mdns.Conf.Debug == true, "Debug isn't true")
-	assert(t, mdns.Conf.BindAddress == "127.0.0.1", "BindAddress isn't 127.0.0.1")
-	assert(t, mdns.Conf.BindPort == "5354", "BindPort isn't 5354")
+	equals(t, []mdns.ListenAddr{
+		mdns.ListenAddr{Net: "tcp", Host: "127.0.0.1", Port: "5354"},
+		mdns.ListenAddr{Net: "udp", Host: "127.0.0.1", Port: "5354"},
+	}, mdns.Conf.Listen)
 	assert(t, mdns.Conf.DbType == "mysql", "DbType isn't mysql")
 	assert(t, mdns.Conf.DbConn == "root:password@tcp(127.0.0.1:3306)/designate", "DbConn is wrong")
 }
@@ -42,25 +52,108 @@ func TestLogging(t *testing.T) {
 	assert(t, log.GetLevel() == log.InfoLevel,
 		fmt.Sprintf("Log level isn't info it's: %s", log.GetLevel().String()))
 
+	mdns.Conf.LogFormat = "json"
+	mdns.InitLogging()
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	mdns.NewRequestLog().WithField("qname", "gomdns.com.").Info("Answered request")
+	log.SetOutput(os.Stderr)
+	line := map[string]interface{}{}
+	ok(t, json.Unmarshal(buf.Bytes(), &line))
+	equals(t, "gomdns.com.", line["qname"])
+	assert(t, line["request_id"] != "", "request_id is missing")
+
 	SetTestConfig()
 }
 
+func TestParseListenAddr(t *testing.T) {
+	addr, err := mdns.ParseListenAddr("udp/127.0.0.1:5354")
+	ok(t, err)
+	equals(t, mdns.ListenAddr{Net: "udp", Host: "127.0.0.1", Port: "5354"}, addr)
+	equals(t, "127.0.0.1:5354", addr.Addr())
+
+	addr, err = mdns.ParseListenAddr("tcp/[::1]:5354")
+	ok(t, err)
+	equals(t, mdns.ListenAddr{Net: "tcp", Host: "::1", Port: "5354"}, addr)
+	equals(t, "[::1]:5354", addr.Addr())
+
+	for _, bad := range []string{"127.0.0.1:5354", "sctp/127.0.0.1:5354", "udp/::1:5354",
+		"udp/localhost:5354", "udp/127.0.0.1", "udp/127.0.0.1:"} {
+		_, err = mdns.ParseListenAddr(bad)
+		assert(t, err != nil, fmt.Sprintf("%s should not have parsed", bad))
+	}
+}
+
+func TestParseListenAddrs(t *testing.T) {
+	addrs, err := mdns.ParseListenAddrs("tcp/127.0.0.1:5354, udp/[::1]:5354")
+	ok(t, err)
+	assert(t, len(addrs) == 2, fmt.Sprintf("Wrong number of addresses: %d", len(addrs)))
+
+	_, err = mdns.ParseListenAddrs("")
+	assert(t, err != nil, "An empty list should be an error")
+}
+
+func TestBindListenAddrs(t *testing.T) {
+	addrs, err := mdns.BindListenAddrs("", "")
+	ok(t, err)
+	equals(t, []mdns.ListenAddr{
+		mdns.ListenAddr{Net: "tcp", Host: "127.0.0.1", Port: "5354"},
+		mdns.ListenAddr{Net: "udp", Host: "127.0.0.1", Port: "5354"},
+	}, addrs)
+
+	addrs, err = mdns.BindListenAddrs("::1", "53")
+	ok(t, err)
+	equals(t, "udp/[::1]:53", addrs[1].String())
+
+	_, err = mdns.BindListenAddrs("not-an-ip", "53")
+	assert(t, err != nil, "An invalid -bind_address should be an error")
+}
+
+func TestParseNotifyAllow(t *testing.T) {
+	nets, err := mdns.ParseNotifyAllow("127.0.0.1, 192.0.2.0/24,::1")
+	ok(t, err)
+	equals(t, 3, len(nets))
+	equals(t, "127.0.0.1/32", nets[0].String())
+	equals(t, "192.0.2.0/24", nets[1].String())
+	equals(t, "::1/128", nets[2].String())
+
+	nets, err = mdns.ParseNotifyAllow("")
+	ok(t, err)
+	equals(t, 0, len(nets))
+
+	for _, bad := range []string{"localhost", "192.0.2.0/33", "192.0.2.1:53"} {
+		_, err = mdns.ParseNotifyAllow(bad)
+		assert(t, err != nil, fmt.Sprintf("%s should not have parsed", bad))
+	}
+}
+
 func TestServe(t *testing.T) {
 	SetUp()
 
 	mysql := &mdns.MySQLDriver{}
 	storage := mdns.Storage{Driver: mysql}
 	handler := mdns.NewDefaultMdnsHandler(storage)
+	addrs := []mdns.ListenAddr{
+		mdns.ListenAddr{Net: "tcp", Host: "127.0.0.1", Port: "55555"},
+		mdns.ListenAddr{Net: "udp", Host: "127.0.0.1", Port: "55555"},
+	}
 
-	go mdns.Serve("tcp", "127.0.0.1", "55555", handler)
-	// Wait for a panic
-	time.Sleep(3)
+	listeners, err := mdns.Serve(addrs, handler)
+	ok(t, err)
+	defer listeners.Shutdown()
+	assert(t, len(listeners.Servers) == 2, fmt.Sprintf("Wrong number of servers: %d", len(listeners.Servers)))
+
+	// The same port again should be an error instead of a panic
+	_, err = mdns.Serve(addrs, handler)
+	assert(t, err != nil, "There should have been an error binding 55555 twice")
 }
 
 func TestListen(t *testing.T) {
 	SetUp()
 
-	go mdns.Listen()
-	// Wait for a panic
-	time.Sleep(3)
+	listeners := &mdns.Listeners{Errors: make(chan error, 1)}
+	listeners.Errors <- errors.New("listener failed")
+
+	err := mdns.Listen(listeners)
+	assert(t, err != nil, "Listen should return a listener failure")
 }
@@ -0,0 +1,175 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Zone File Driver
+//
+
+// ZoneFileDriver serves zones from a directory of RFC 1035 zone files, one
+// per zone, named after the zone as export writes them, e.g.
+// example.com.zone. Each file needs exactly one SOA, at the zone's apex. The
+// zones are held, and answered, by a MemoryDriver.
+//
+// Files are reloaded by Reload when their size or modification time
+// changes. A file that fails to parse leaves the copy already loaded in
+// place. As with the database, a cache in front of the driver only notices
+// a change once the zone's serial moves.
+type ZoneFileDriver struct {
+	dir    string
+	memory *MemoryDriver
+	mutex  sync.Mutex
+	files  map[string]zoneFile
+	stop   chan struct{}
+}
+
+// zoneFile is the zone a file was last loaded as, and the size and
+// modification time it had then.
+type zoneFile struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+func NewZoneFileDriver(dir string) *ZoneFileDriver {
+	return &ZoneFileDriver{dir: dir, memory: NewMemoryDriver(), files: map[string]zoneFile{}}
+}
+
+// Open loads every zone file in the directory.
+func (files *ZoneFileDriver) Open() error {
+	if err := files.Reload(); err != nil {
+		return err
+	}
+	files.mutex.Lock()
+	log.Info(fmt.Sprintf("Loaded %d zones from %s", len(files.files), files.dir))
+	files.mutex.Unlock()
+	return nil
+}
+
+// Ping succeeds while the directory can be read.
+func (files *ZoneFileDriver) Ping(ctx context.Context) error {
+	_, err := ioutil.ReadDir(files.dir)
+	return err
+}
+
+// Reload loads the zone files that are new or have changed since they were
+// last loaded, and drops the zones whose file has gone. Files that fail to
+// load are logged and skipped, and only failing to read the directory is
+// returned.
+func (files *ZoneFileDriver) Reload() error {
+	infos, err := ioutil.ReadDir(files.dir)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error reading zone directory %s: %s", files.dir, err))
+		return err
+	}
+
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+
+	current := map[string]zoneFile{}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".zone") {
+			continue
+		}
+		path := filepath.Join(files.dir, info.Name())
+		previous, ok := files.files[path]
+		if ok && previous.modTime.Equal(info.ModTime()) && previous.size == info.Size() {
+			current[path] = previous
+			continue
+		}
+
+		rrs, err := loadZoneFile(path)
+		if err != nil {
+			log.Error(fmt.Sprintf("Error loading zone file %s: %s", path, err))
+			if ok {
+				current[path] = previous
+			}
+			continue
+		}
+		files.memory.setZone(rrs)
+		soa := rrs[0].(*dns.SOA)
+		current[path] = zoneFile{name: strings.ToLower(soa.Hdr.Name), modTime: info.ModTime(), size: info.Size()}
+		log.Info(fmt.Sprintf("Loaded %s serial %d from %s, %d records", soa.Hdr.Name, soa.Serial, path, len(rrs)-1))
+	}
+
+	for path, file := range files.files {
+		if _, ok := current[path]; !ok {
+			files.memory.RemoveZone(file.name)
+			log.Info(fmt.Sprintf("Zone file for %s is gone, no longer serving it", file.name))
+		}
+	}
+	files.files = current
+	return nil
+}
+
+// loadZoneFile parses the zone file at path, whose origin is its name without
+// the .zone suffix.
+func loadZoneFile(path string) ([]dns.RR, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseZone(file, strings.TrimSuffix(filepath.Base(path), ".zone"), path)
+}
+
+func (files *ZoneFileDriver) FindZone(ctx context.Context, qname string) (Zone, error) {
+	return files.memory.FindZone(ctx, qname)
+}
+
+func (files *ZoneFileDriver) GetFullAxfrRRs(ctx context.Context, zonename string) ([]dns.RR, error) {
+	return files.memory.GetFullAxfrRRs(ctx, zonename)
+}
+
+func (files *ZoneFileDriver) GetQueryRRs(ctx context.Context, RRName string, RRType string) ([]dns.RR, error) {
+	return files.memory.GetQueryRRs(ctx, RRName, RRType)
+}
+
+func (files *ZoneFileDriver) GetZoneSerials(ctx context.Context) (map[string]uint32, error) {
+	return files.memory.GetZoneSerials(ctx)
+}
+
+// StartWatching reloads changed zone files every interval until Stop is
+// called.
+func (files *ZoneFileDriver) StartWatching(interval time.Duration) {
+	files.mutex.Lock()
+	if files.stop == nil {
+		files.stop = make(chan struct{})
+	}
+	stop := files.stop
+	files.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				files.Reload()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends watching.
+func (files *ZoneFileDriver) Stop() {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	if files.stop != nil {
+		close(files.stop)
+		files.stop = nil
+	}
+}
@@ -0,0 +1,117 @@
+package mdns_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rackerlabs/mdns"
+)
+
+// writeZone writes a zone file for example.com. with the given serial and
+// www address, dated in the future so that each write is seen as a change.
+func writeZone(t *testing.T, dir string, serial int, address string) {
+	path := filepath.Join(dir, "example.com.zone")
+	text := fmt.Sprintf(`$ORIGIN example.com.
+$TTL 3600
+@	IN SOA ns1 hostmaster %d 3600 600 86400 300
+@	IN NS ns1
+ns1	IN A 192.0.2.53
+www	300 IN A %s
+`, serial, address)
+	ok(t, ioutil.WriteFile(path, []byte(text), 0644))
+	future := time.Now().Add(time.Duration(serial) * time.Second)
+	ok(t, os.Chtimes(path, future, future))
+}
+
+func openZoneDir(t *testing.T) (*mdns.ZoneFileDriver, string) {
+	SetUp()
+	dir, err := ioutil.TempDir("", "mdns-zonefile")
+	ok(t, err)
+	writeZone(t, dir, 1, "192.0.2.1")
+
+	files := mdns.NewZoneFileDriver(dir)
+	ok(t, files.Open())
+	return files, dir
+}
+
+func TestZoneFileQuery(t *testing.T) {
+	files, dir := openZoneDir(t)
+	defer os.RemoveAll(dir)
+
+	equals(t, []string{"192.0.2.1"}, queryA(t, files, "www.example.com."))
+	equals(t, []string{"192.0.2.1"}, queryA(t, files, "WWW.Example.com."))
+	equals(t, []string{}, queryA(t, files, "missing.example.com."))
+	equals(t, []string{}, queryA(t, files, "www.example.net."))
+
+	rrs, err := files.GetQueryRRs(mdns.NewRequestContext(), "example.com.", "ANY")
+	ok(t, err)
+	equals(t, 2, len(rrs))
+
+	zone, err := files.FindZone(mdns.NewRequestContext(), "www.example.com.")
+	ok(t, err)
+	equals(t, "example.com.", zone.Name)
+	equals(t, uint32(1), zone.Serial)
+}
+
+func TestZoneFileAxfr(t *testing.T) {
+	files, dir := openZoneDir(t)
+	defer os.RemoveAll(dir)
+
+	rrs, err := files.GetFullAxfrRRs(mdns.NewRequestContext(), "example.com.")
+	ok(t, err)
+	equals(t, 5, len(rrs))
+	_, first := rrs[0].(*dns.SOA)
+	_, last := rrs[len(rrs)-1].(*dns.SOA)
+	assert(t, first && last, "AXFR should start and end with the SOA")
+
+	_, err = files.GetFullAxfrRRs(mdns.NewRequestContext(), "example.net.")
+	equals(t, sql.ErrNoRows, err)
+}
+
+func TestZoneFileReload(t *testing.T) {
+	files, dir := openZoneDir(t)
+	defer os.RemoveAll(dir)
+
+	writeZone(t, dir, 2, "192.0.2.2")
+	ok(t, files.Reload())
+	equals(t, []string{"192.0.2.2"}, queryA(t, files, "www.example.com."))
+	serials, err := files.GetZoneSerials(mdns.NewRequestContext())
+	ok(t, err)
+	equals(t, map[string]uint32{"example.com.": 2}, serials)
+
+	// A broken file leaves the last good copy in place
+	path := filepath.Join(dir, "example.com.zone")
+	ok(t, ioutil.WriteFile(path, []byte("www IN A not-an-address\n"), 0644))
+	ok(t, files.Reload())
+	equals(t, []string{"192.0.2.2"}, queryA(t, files, "www.example.com."))
+
+	ok(t, os.Remove(path))
+	ok(t, files.Reload())
+	serials, err = files.GetZoneSerials(mdns.NewRequestContext())
+	ok(t, err)
+	equals(t, map[string]uint32{}, serials)
+}
+
+func TestZoneFileServe(t *testing.T) {
+	files, dir := openZoneDir(t)
+	defer os.RemoveAll(dir)
+
+	handler := mdns.NewDefaultMdnsHandler(mdns.Storage{Driver: mdns.NewCachingDriver(files, 1<<20)})
+	writer := &FakeResponseWriter{}
+	request := generateMsg("www.example.com.", dns.TypeA, dns.OpcodeQuery)
+	handler.ServeDNS(writer, &request)
+	equals(t, dns.RcodeSuccess, writer.GetMsgs()[0].Rcode)
+	equals(t, 1, len(writer.GetMsgs()[0].Answer))
+
+	writer = &FakeResponseWriter{}
+	request = generateMsg("example.com.", dns.TypeAXFR, dns.OpcodeQuery)
+	handler.ServeDNS(writer, &request)
+	equals(t, 1, len(writer.GetMsgs()))
+	equals(t, 5, len(writer.GetMsgs()[0].Answer))
+}